@@ -1,85 +1,1345 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"math"
+	"math/bits"
+	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
-	"sort"
+	rtdebug "runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// options controls processing, zero value selects defaults.
+type options struct {
+	// workers is the number of goroutines processing chunks in parallel, runtime.NumCPU() if not positive
+	workers int
+	// chunkBytes is the approximate size of chunks, chunksPerWorker chunks per worker if not positive
+	chunkBytes int
+
+	// delimiter separates station name and value, ';' if zero
+	delimiter byte
+	// valueFirst enables records with the value before the station name
+	valueFirst bool
+	// missingValues handles NaN and empty values: skip, zero or error,
+	// if empty they are skipped unless strict mode fails on them as malformed
+	missingValues string
+	// strict enables validation of input lines
+	strict bool
+	// verify enables comparison of the result with the serial reference implementation
+	verify bool
+	// normalize is the station name normalization: "trim" trims surrounding whitespace,
+	// "fold" also lowercases names, disabled if empty
+	normalize string
+	// groupSep enables aggregation by the leading segments of station names separated by it
+	groupSep string
+	// groupLevel is the number of groupSep segments to aggregate by, 1 if not positive
+	groupLevel int
+	// escape enables backslash escaped delimiters in station names
+	escape bool
+	// fahrenheit enables conversion of input temperatures in Fahrenheit to Celsius on output
+	fahrenheit bool
+	// allowExponent enables parsing of temperatures in scientific notation, e.g. 1.2e1
+	allowExponent bool
+	// withTimestamp enables tracking of the optional third column timestamp range
+	withTimestamp bool
+	// ignoreComments enables skipping of lines starting with '#' after optional whitespace
+	ignoreComments bool
+	// tempFilter enables skipping of temperatures outside of [minTemp, maxTemp] range in tenths of degree
+	tempFilter       bool
+	minTemp, maxTemp int64
+	// maxAbsTemp enables failing on temperatures beyond [-maxAbsTemp, maxAbsTemp] range
+	// in tenths of degree if positive
+	maxAbsTemp int64
+	// stations is the expected number of stations used to presize tables
+	stations int
+	// percentiles enables tracking of measurement percentiles
+	percentiles bool
+	// progress accumulates processed bytes if not nil
+	progress *progress
+	// timings accumulates wall time of processing phases if not nil
+	timings *timings
+	// limit limits the total number of processed lines if not nil
+	limit *lineLimit
+	// offset and length restrict processing to the byte range [offset, offset+length) of every file
+	// snapped to line boundaries, the range extends to the end of file if length is not positive
+	offset, length int64
+	// endings counts line endings if not nil
+	endings *lineEndings
+	// lines counts processed input lines including skipped ones if not nil
+	lines *atomic.Int64
+	// dryRun validates lines instead of aggregating them if not nil
+	dryRun *dryRun
+	// maxMemory limits memory of measurements, if positive stations are spilled
+	// to temporary files when they exceed it
+	maxMemory int64
+	// spill receives measurements when maxMemory is set
+	spill *spill
+	// load is the snapshot file of prior measurements to merge the input into, disabled if empty
+	load string
+	// save is the snapshot file to write measurements to for a later load, disabled if empty
+	save string
+	// ctx cancels processing if not nil
+	ctx context.Context
+	// shuffle enables dispatch of chunks to workers in random order seeded by shuffleSeed
+	shuffle     bool
+	shuffleSeed int64
+	// incrementalMerge enables merging of every worker table into the result after each chunk
+	// and resetting it for the next one, instead of merging all tables in parallel at the end.
+	// Worker tables hold stations of a single chunk and the result copies measurements
+	// instead of referring to table entries which lowers memory at the cost of lock contention.
+	incrementalMerge bool
+	// chunkResults receives measurements of every chunk in file order instead of merging them if not nil
+	chunkResults *[]map[string]*measurement
+	// noAdvise disables sequential access advice for memory-mapped files
+	noAdvise bool
+	// dumpChunks enables writing of chunk boundaries to diagnostics
+	dumpChunks bool
+
+	// output options
+
+	// format is the output format, see formatters
+	format string
+	// filenames are the input file names of the output metadata, set by run
+	filenames []string
+	// output is the result file name, stdout if empty
+	output string
+	// stderr receives diagnostics, os.Stderr if nil
+	stderr io.Writer
+	// quiet discards diagnostics except details of errors
+	quiet bool
+	// stddev enables output of population standard deviation
+	stddev bool
+	// count enables output of the number of measurements
+	count bool
+	// precision is the number of decimals of min, mean and max, 1 if not positive
+	precision int
+	// summary enables output of the number of processed lines and stations to stderr
+	summary bool
+	// extremes enables output of the hottest and the coldest station to stderr
+	extremes bool
+	// checksum enables output of SHA-256 hash of the result to stderr
+	checksum bool
+	// sort is the output order, see sortOrders
+	sort string
+	// rounding is the rounding mode of the mean, see roundings, half-up if empty
+	rounding string
+	// collate is the language of station name ordering, byte order if empty or "byte"
+	collate string
+	// include limits output to stations with names matching the path.Match pattern, all if empty
+	include string
+	// exclude omits stations with names matching the path.Match pattern after include
+	exclude string
+	// top limits output to the first stations in output order, all if not positive
+	top int
+	// global enables output of the aggregate of all stations after them
+	global bool
+	// stationsFile lists stations to output in the listed order instead of the measured ones
+	stationsFile string
+	// missing is the output value of listed stations without measurements, "NaN" if empty
+	missing string
+}
+
 type measurement struct {
 	min, max, sum, count int64
+	// sumSquares is used to calculate standard deviation
+	sumSquares int64
+	// hist is used to calculate percentiles, nil unless enabled
+	hist *histogram
+	// span is the range of measurement timestamps, nil unless measured
+	span *timeSpan
+	// firstSeen is the input offset of the first measurement if tracked for first-seen order
+	firstSeen int64
+}
+
+// Stats holds aggregated measurements of a single station in degrees.
+type Stats struct {
+	min, max, sum float64
+	count         int64
+	// StdDev is the population standard deviation
+	StdDev float64
+	// P50, P95 and P99 are percentiles of measurements if enabled
+	P50, P95, P99 float64
+	// First and Last are the earliest and latest timestamps of measurements if measured
+	First, Last int64
+	timestamps  bool
+	// firstSeen is the input offset of the first measurement for first-seen order
+	firstSeen int64
+}
+
+// Min returns the minimum temperature.
+func (s Stats) Min() float64 {
+	return s.min
+}
+
+// Max returns the maximum temperature.
+func (s Stats) Max() float64 {
+	return s.max
+}
+
+// Mean returns the mean temperature rounded to one decimal like in the output.
+func (s Stats) Mean() float64 {
+	return round(s.mean())
+}
+
+// HasTimestamps reports whether First and Last are set.
+func (s Stats) HasTimestamps() bool {
+	return s.timestamps
+}
+
+// Count returns the number of measurements.
+func (s Stats) Count() int64 {
+	return s.count
+}
+
+// mean returns the unrounded mean temperature.
+func (s Stats) mean() float64 {
+	return s.sum / float64(s.count)
+}
+
+func main() {
+	os.Exit(realMain())
+}
+
+// realMain runs the command and returns its exit code so that deferred cleanup,
+// e.g. stopping of profiles, runs before exit.
+func realMain() int {
+	var opts options
+	flag.IntVar(&opts.workers, "workers", 0, "number of parallel workers, defaults to the number of CPUs")
+	flag.Func("chunk-bytes", "split files into chunks of about `size` bytes, e.g. 64M, instead of a few chunks per worker", func(s string) error {
+		n, err := parseSize(s)
+		if err != nil {
+			return err
+		}
+		opts.chunkBytes = n
+		return nil
+	})
+	flag.Func("delimiter", "single byte separating station name and value (default ;), use \\t for tab", func(s string) error {
+		if s == `\t` {
+			s = "\t"
+		}
+		if len(s) != 1 {
+			return errors.New("must be a single byte")
+		}
+		opts.delimiter = s[0]
+		return nil
+	})
+	flag.Func("format-order", "order of record fields: name-first or value-first (default name-first)", func(s string) error {
+		if s != "name-first" && s != "value-first" {
+			return errors.New("must be name-first or value-first")
+		}
+		opts.valueFirst = s == "value-first"
+		return nil
+	})
+	flag.Func("missing-values", "handling of NaN and empty values: skip, zero or error (default skip)", func(s string) error {
+		if s != "skip" && s != "zero" && s != "error" {
+			return errors.New("must be skip, zero or error")
+		}
+		opts.missingValues = s
+		return nil
+	})
+	flag.BoolVar(&opts.strict, "strict", false, "validate input matches the reference format and fail on the first malformed line")
+	flag.BoolVar(&opts.verify, "verify", false, "compare the result with a slow serial aggregation and fail if they differ")
+	flag.Func("normalize", "normalize station names: trim surrounding whitespace or fold to also lowercase them", func(s string) error {
+		if s != "trim" && s != "fold" {
+			return errors.New("must be trim or fold")
+		}
+		opts.normalize = s
+		return nil
+	})
+	flag.StringVar(&opts.groupSep, "group-sep", "", "aggregate by leading segments of station names separated by `sep`, e.g. / to aggregate EU/Berlin and EU/Paris as EU")
+	flag.IntVar(&opts.groupLevel, "group-level", 1, "number of -group-sep segments of station names to aggregate by")
+	flag.BoolVar(&opts.escape, "escape", false, "allow delimiter escaped by backslash in station names, e.g. North\\;South")
+	flag.Func("input-unit", "unit of input temperatures: C or F converted to Celsius (default C)", func(s string) error {
+		if s != "C" && s != "F" {
+			return errors.New("must be C or F")
+		}
+		opts.fahrenheit = s == "F"
+		return nil
+	})
+	flag.BoolVar(&opts.allowExponent, "allow-exponent", false, "accept temperatures in scientific notation, e.g. 1.2e1")
+	flag.BoolVar(&opts.withTimestamp, "with-timestamp", false, "track the first and last timestamp of the optional third column, e.g. Hamburg;12.0;1700000000")
+	flag.BoolVar(&opts.ignoreComments, "ignore-comments", false, "skip lines starting with # after optional whitespace")
+	flag.Func("min-temp", "skip temperatures below the value", func(s string) error {
+		temp, err := parseDegrees(s)
+		if err != nil {
+			return err
+		}
+		opts.enableTempFilter()
+		opts.minTemp = temp
+		return nil
+	})
+	flag.Func("max-temp", "skip temperatures above the value", func(s string) error {
+		temp, err := parseDegrees(s)
+		if err != nil {
+			return err
+		}
+		opts.enableTempFilter()
+		opts.maxTemp = temp
+		return nil
+	})
+	flag.BoolFunc("assert-finite", "fail on temperatures beyond ±1000 degrees, use -assert-finite=`bound` for another bound", func(s string) error {
+		if s == "true" {
+			s = "1000"
+		}
+		bound, err := parseDegrees(s)
+		if err != nil || bound <= 0 {
+			return errors.New("must be a positive number of degrees")
+		}
+		opts.maxAbsTemp = bound
+		return nil
+	})
+	flag.Func("max-memory", "spill stations to temporary files when their measurements exceed about `size` bytes, e.g. 1G", func(s string) error {
+		n, err := parseSize(s)
+		if err != nil {
+			return err
+		}
+		opts.maxMemory = int64(n)
+		return nil
+	})
+	flag.Func("limit", "stop after processing `n` lines in total, e.g. to sample a large dataset", func(s string) error {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			return errors.New("must be a positive integer")
+		}
+		opts.limit = newLineLimit(n)
+		return nil
+	})
+	flag.Func("offset", "process lines starting at or after byte `offset`, e.g. to reproduce a problem of a file region", func(s string) error {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative integer")
+		}
+		opts.offset = n
+		return nil
+	})
+	flag.Func("length", "process lines starting within `n` bytes from -offset", func(s string) error {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			return errors.New("must be a positive integer")
+		}
+		opts.length = n
+		return nil
+	})
+	flag.StringVar(&opts.load, "load", "", "merge measurements of the snapshot `file` saved by -save into the result")
+	flag.StringVar(&opts.save, "save", "", "save measurements to the snapshot `file` to -load them on the next run, e.g. to add new files incrementally")
+	randomSeed := false
+	flag.BoolFunc("shuffle", "dispatch chunks to workers in random order, use -shuffle=`seed` to repeat the order", func(s string) error {
+		if s == "true" {
+			opts.shuffle, opts.shuffleSeed = true, time.Now().UnixNano()
+			randomSeed = true
+			return nil
+		}
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer seed")
+		}
+		opts.shuffle, opts.shuffleSeed = true, seed
+		return nil
+	})
+	flag.BoolVar(&opts.incrementalMerge, "incremental-merge", false, "merge results of every chunk as it completes to lower memory with many stations")
+	flag.IntVar(&opts.stations, "stations", 0, "expected number of stations to presize tables for")
+	flag.StringVar(&opts.format, "format", "default", "output format: default, compact, json, json-envelope, ndjson, csv or table")
+	flag.StringVar(&opts.output, "output", "", "write result to the file instead of stdout")
+	flag.BoolVar(&opts.stddev, "stddev", false, "output population standard deviation")
+	flag.BoolVar(&opts.percentiles, "percentiles", false, "output p50, p95 and p99 percentiles")
+	flag.BoolVar(&opts.count, "count", false, "output the number of measurements per station")
+	flag.BoolVar(&opts.summary, "stats", false, "print the number of processed lines and stations to stderr")
+	flag.BoolVar(&opts.extremes, "extremes", false, "print the station with the highest max and the station with the lowest min to stderr")
+	flag.BoolVar(&opts.quiet, "quiet", false, "print nothing but errors to stderr, e.g. to silence -progress and -stats in scripts")
+	flag.BoolVar(&opts.checksum, "checksum", false, "print SHA-256 of the output to stderr to compare results of different runs")
+	flag.Func("precision", "number of decimals of min, mean and max (default 1)", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPrecision {
+			return fmt.Errorf("must be a positive integer up to %d", maxPrecision)
+		}
+		opts.precision = n
+		return nil
+	})
+	flag.StringVar(&opts.rounding, "rounding", "half-up", "rounding of the mean: half-up, half-even or truncate")
+	flag.StringVar(&opts.sort, "sort", "name", "output order: name, min (coldest first), mean, max (hottest first) or first-seen in input")
+	flag.StringVar(&opts.include, "include", "", "output only stations with names matching the glob `pattern`, e.g. B*")
+	flag.StringVar(&opts.exclude, "exclude", "", "omit stations with names matching the glob `pattern` after -include, e.g. *lin")
+	flag.IntVar(&opts.top, "top", 0, "output only the first `n` stations in -sort order, e.g. -sort=max -top=10 for the 10 hottest")
+	flag.StringVar(&opts.stationsFile, "stations-file", "", "output stations listed one per line in the `file` in its order")
+	flag.StringVar(&opts.missing, "missing", "NaN", "output value of -stations-file stations without measurements")
+	flag.BoolVar(&opts.global, "global", false, "also output the aggregate of all stations as "+globalId)
+	flag.StringVar(&opts.collate, "collate", "byte", "station name order: byte or BCP 47 language tag for Unicode collation, e.g. und, de or sv")
+	flag.BoolVar(&opts.dumpChunks, "dump-chunks", false, "write chunk offsets with their first and last lines to stderr")
+	checkEndings := flag.Bool("check-endings", false, "count LF, CRLF and bare CR line endings and warn about mixed ones to stderr")
+	validate := flag.Bool("dry-run", false, "validate lines without aggregating and report malformed ones to stderr")
+	showProgress := flag.Bool("progress", false, "periodically report progress to stderr")
+	showTimings := flag.Bool("timings", false, "print nanoseconds spent in mmap, chunk, process, merge and print phases to stderr")
+	madvise := flag.Bool("madvise", true, "advise the kernel to read memory-mapped files ahead (Linux only)")
+	serveAddr := flag.String("serve", "", "serve the result as JSON at /stats HTTP endpoint on `addr` instead of printing it")
+	errorsTo := flag.String("errors-to", "", "append diagnostics and errors to the `file` instead of stderr")
+	manifest := flag.String("manifest", "", "also aggregate files listed one per line in the `file`, relative to its directory")
+	cpuProfile := flag.String("cpuprofile", "", "write CPU profile to the `file`")
+	memProfile := flag.String("memprofile", "", "write heap profile to the `file` at exit")
+	flag.Usage = usage
+	flag.Parse()
+
+	opts.noAdvise = !*madvise
+	if *validate {
+		opts.dryRun = new(dryRun)
+	}
+	if *checkEndings {
+		opts.endings = new(lineEndings)
+	}
+	if *showTimings {
+		opts.timings = new(timings)
+	}
+
+	if *errorsTo != "" {
+		f, err := os.OpenFile(*errorsTo, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer f.Close()
+
+		opts.stderr = f
+		log.SetOutput(f)
+	}
+
+	if randomSeed {
+		fmt.Fprintf(opts.diagnostics(), "shuffle seed %d\n", opts.shuffleSeed)
+	}
+
+	filenames := flag.Args()
+	if *manifest != "" {
+		paths, err := readManifest(*manifest)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		filenames = append(filenames, paths...)
+	}
+	if len(filenames) == 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "Missing measurements filename")
+		flag.Usage()
+		return 2
+	}
+
+	stopProfiles, err := startProfiles(*cpuProfile, *memProfile)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer func() {
+		if err := stopProfiles(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	if *showProgress && !opts.quiet {
+		opts.progress = new(progress)
+		stop := opts.progress.report(opts.diagnostics(), 500*time.Millisecond)
+		defer stop()
+	}
+
+	// cancel processing on interrupt so that files are unmapped before exit,
+	// the second signal terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	opts.ctx = ctx
+
+	if *serveAddr != "" {
+		if err := serve(ctx, *serveAddr, filenames, &opts); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := run(filenames, &opts, os.Stdout); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// parseSize parses positive number of bytes with optional K, M or G binary suffix.
+func parseSize(s string) (int, error) {
+	scale := 1
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			scale = 1 << 10
+		case 'M', 'm':
+			scale = 1 << 20
+		case 'G', 'g':
+			scale = 1 << 30
+		}
+		if scale > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > math.MaxInt/scale {
+		return 0, errors.New("must be a positive number of bytes with optional K, M or G suffix")
+	}
+	return n * scale, nil
+}
+
+// readLines reads lines of the file skipping empty ones.
+func readLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSuffix(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readManifest reads paths listed one per line resolving relative paths against the manifest directory.
+func readManifest(filename string) ([]string, error) {
+	paths, err := readLines(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	for i, path := range paths {
+		if !filepath.IsAbs(path) {
+			paths[i] = filepath.Join(dir, path)
+		}
+	}
+	return paths, nil
+}
+
+// usage prints command line syntax and flags.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] file...\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(w, "Prints min/mean/max temperature per station of the measurements files, use - to read stdin.")
+	fmt.Fprintln(w, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// diagnostics returns writer of diagnostic messages, io.Discard in quiet mode.
+func (opts *options) diagnostics() io.Writer {
+	if opts.quiet {
+		return io.Discard
+	}
+	return opts.errorDetails()
+}
+
+// errorDetails returns writer of error details which are not discarded in quiet mode.
+func (opts *options) errorDetails() io.Writer {
+	if opts.stderr == nil {
+		return os.Stderr
+	}
+	return opts.stderr
+}
+
+// run aggregates measurements of the files and writes formatted result to the output file or stdout.
+// Diagnostics are written to opts.stderr and never mix with the result.
+func run(filenames []string, opts *options, stdout io.Writer) (err error) {
+	if opts.verify && opts.limit != nil {
+		return errors.New("verification of limited number of lines is not supported")
+	}
+	if opts.verify && opts.byteRange() {
+		return errors.New("verification of byte range is not supported")
+	}
+	write, err := opts.formatter()
+	if err != nil {
+		return err
+	}
+	order, err := opts.order()
+	if err != nil {
+		return err
+	}
+	if _, ok := roundings[opts.rounding]; !ok && opts.rounding != "" {
+		return fmt.Errorf("unknown rounding: %s", opts.rounding)
+	}
+	if opts.precision > maxPrecision {
+		return fmt.Errorf("precision exceeds %d decimals: %d", maxPrecision, opts.precision)
+	}
+	collator, err := opts.collator()
+	if err != nil {
+		return err
+	}
+	if err := opts.checkFilters(); err != nil {
+		return err
+	}
+	var listed []string
+	if opts.stationsFile != "" {
+		if listed, err = readLines(opts.stationsFile); err != nil {
+			return err
+		}
+	}
+
+	if opts.format == "json-envelope" {
+		envelopeOpts := *opts
+		envelopeOpts.filenames = filenames
+		opts = &envelopeOpts
+	}
+
+	if opts.load != "" || opts.save != "" {
+		if err := opts.checkSnapshot(); err != nil {
+			return err
+		}
+	}
+
+	if opts.summary {
+		summaryOpts := *opts
+		summaryOpts.lines = new(atomic.Int64)
+		opts = &summaryOpts
+	}
+
+	spilled := false
+	if opts.maxMemory > 0 {
+		if err := opts.checkSpill(); err != nil {
+			return err
+		}
+		s, err := newSpill(opts.maxMemory)
+		if err != nil {
+			return err
+		}
+		defer s.remove()
+
+		spillOpts := *opts
+		spillOpts.spill = s
+		opts = &spillOpts
+	}
+
+	processed, err := processFiles(filenames, opts)
+	if err != nil {
+		return err
+	}
+	if opts.spill != nil {
+		if processed, spilled, err = opts.spill.finish(); err != nil {
+			return err
+		}
+	}
+	if opts.endings != nil {
+		if err := opts.endings.report(opts.diagnostics()); err != nil {
+			return err
+		}
+	}
+	if opts.dryRun != nil {
+		// the report is the result of dry run so it is not discarded in quiet mode
+		return opts.dryRun.report(opts.errorDetails())
+	}
+	if opts.load != "" {
+		prior, err := loadSnapshot(opts.load)
+		if err != nil {
+			return err
+		}
+		if err := mergeSnapshot(processed, prior); err != nil {
+			return err
+		}
+	}
+	if opts.save != "" {
+		if err := saveSnapshot(opts.save, processed); err != nil {
+			return err
+		}
+	}
+	measurements := opts.statsOf(processed)
+
+	if opts.verify {
+		if err := verify(opts.errorDetails(), filenames, measurements, opts); err != nil {
+			return err
+		}
+	}
+	if opts.summary {
+		if err := writeSummary(opts.diagnostics(), opts.lines.Load(), len(measurements)); err != nil {
+			return err
+		}
+	}
+	if opts.extremes {
+		if err := writeExtremes(opts.diagnostics(), measurements, opts); err != nil {
+			return err
+		}
+	}
+
+	out := stdout
+	if opts.output != "" {
+		f, err := os.Create(opts.output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+	if opts.checksum {
+		h := sha256.New()
+		out = io.MultiWriter(out, h)
+		defer func() {
+			if err == nil {
+				_, err = fmt.Fprintf(opts.diagnostics(), "sha256 %x\n", h.Sum(nil))
+			}
+		}()
+	}
+
+	if opts.timings != nil {
+		defer func(start time.Time) {
+			opts.timePhase("print", start)
+			if err == nil {
+				err = opts.timings.report(opts.diagnostics())
+			}
+		}(time.Now())
+	}
+
+	if spilled {
+		return opts.spill.write(out, lineFormats[opts.format], opts)
+	}
+
+	ids := listed
+	if ids == nil {
+		ids = sortedIds(measurements)
+		if collator != nil {
+			collator.SortStrings(ids)
+		}
+		if order != nil {
+			// stable sort keeps name order of ties
+			slices.SortStableFunc(ids, func(a, b string) int { return order(measurements[a], measurements[b]) })
+		}
+	}
+	ids = opts.filter(ids)
+	if opts.top > 0 && opts.top < len(ids) {
+		ids = ids[:opts.top]
+	}
+	if opts.global && len(processed) > 0 {
+		measurements[globalId] = opts.stats(globalMeasurement(processed))
+		ids = append(ids, globalId)
+	}
+
+	if streamingFormats[opts.format] {
+		return write(out, ids, measurements, opts)
+	}
+
+	// format the whole result before writing it at once
+	var buf bytes.Buffer
+	if err := write(&buf, ids, measurements, opts); err != nil {
+		return err
+	}
+	_, err = out.Write(buf.Bytes())
+	return err
+}
+
+// Aggregate computes per station statistics of the measurements file.
+func Aggregate(filename string) (Results, error) {
+	return aggregate([]string{filename}, &options{})
+}
+
+// AggregateContext is like Aggregate but stops processing and returns the context error
+// once ctx is done.
+func AggregateContext(ctx context.Context, filename string) (Results, error) {
+	return aggregate([]string{filename}, &options{ctx: ctx})
+}
+
+// AggregateReader is like Aggregate but reads measurements from r, e.g. strings.Reader,
+// decompressing it if necessary.
+func AggregateReader(r io.Reader) (Results, error) {
+	measurements, err := processStream(r, &options{})
+	if err != nil {
+		return nil, err
+	}
+	return statsOf(measurements), nil
+}
+
+// AggregateWithSink is like Aggregate but passes statistics of every station to the sink
+// in name order instead of returning them. Stations are final only once all chunks are merged,
+// so the sink is called after processing, yet without building the output of all stations.
+func AggregateWithSink(filename string, sink func(name string, s Stats)) error {
+	results, err := Aggregate(filename)
+	if err != nil {
+		return err
+	}
+	for id, s := range results.All() {
+		sink(id, s)
+	}
+	return nil
+}
+
+// AggregateChunks computes per station statistics of every chunk the measurements file
+// is split into for parallel processing by Aggregate, e.g. to inspect how stations
+// are distributed across regions of the file.
+func AggregateChunks(filename string) (_ []Results, err error) {
+	var chunks []map[string]*measurement
+	opts := &options{chunkResults: &chunks}
+	f, size, stream, err := openInput(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if stream {
+		return nil, fmt.Errorf("compressed or irregular file is not split into chunks: %s", filename)
+	}
+
+	data, unmap, _, err := mapData(f, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if uerr := unmap(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	if _, err := process(data, opts); err != nil {
+		return nil, err
+	}
+
+	results := make([]Results, len(chunks))
+	for i, m := range chunks {
+		results[i] = statsOf(m)
+	}
+	return results, nil
+}
+
+// aggregate computes per station statistics of the files as a single dataset.
+func aggregate(filenames []string, opts *options) (map[string]Stats, error) {
+	measurements, err := processFiles(filenames, opts)
+	if err != nil {
+		return nil, err
+	}
+	return opts.statsOf(measurements), nil
+}
+
+func statsOf(measurements map[string]*measurement) map[string]Stats {
+	result := make(map[string]Stats, len(measurements))
+	for id, m := range measurements {
+		result[id] = m.stats()
+	}
+	return result
+}
+
+// statsOf is like the statsOf function but converts temperatures to Celsius if input is in Fahrenheit.
+func (opts *options) statsOf(measurements map[string]*measurement) map[string]Stats {
+	if !opts.fahrenheit {
+		return statsOf(measurements)
+	}
+	result := make(map[string]Stats, len(measurements))
+	for id, m := range measurements {
+		result[id] = opts.stats(m)
+	}
+	return result
+}
+
+// stats is like measurement.stats but converts temperatures to Celsius if input is in Fahrenheit.
+// Measurements are kept in tenths of input degree so the conversion is exact
+// as min, max, mean and percentiles are linear in measured values.
+func (opts *options) stats(m *measurement) Stats {
+	s := m.stats()
+	if !opts.fahrenheit {
+		return s
+	}
+	s.min, s.max = fahrenheitToCelsius(s.min), fahrenheitToCelsius(s.max)
+	s.sum = (s.sum - 32*float64(s.count)) * 5 / 9
+	s.StdDev = s.StdDev * 5 / 9
+	if m.hist != nil {
+		s.P50, s.P95, s.P99 = fahrenheitToCelsius(s.P50), fahrenheitToCelsius(s.P95), fahrenheitToCelsius(s.P99)
+	}
+	return s
+}
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// globalId is the id of the aggregate of all stations.
+const globalId = "__global__"
+
+// globalMeasurement folds measurements of all stations into one.
+func globalMeasurement(measurements map[string]*measurement) *measurement {
+	g := &measurement{min: math.MaxInt64, max: math.MinInt64}
+	for _, m := range measurements {
+		// merge into own histogram instead of taking over the one of the first station
+		if m.hist != nil && g.hist == nil {
+			g.hist = new(histogram)
+		}
+		if m.span != nil && g.span == nil {
+			g.span = &timeSpan{first: math.MaxInt64, last: math.MinInt64}
+		}
+		g.merge(m)
+	}
+	return g
+}
+
+func (m *measurement) stats() Stats {
+	s := Stats{
+		min:    float64(m.min) / 10.0,
+		max:    float64(m.max) / 10.0,
+		sum:    float64(m.sum) / 10.0,
+		count:  m.count,
+		StdDev: m.stdDev() / 10.0,
+	}
+	if m.hist != nil {
+		s.P50 = float64(m.hist.percentile(50)) / 10.0
+		s.P95 = float64(m.hist.percentile(95)) / 10.0
+		s.P99 = float64(m.hist.percentile(99)) / 10.0
+	}
+	if m.span != nil {
+		s.First, s.Last, s.timestamps = m.span.first, m.span.last, true
+	}
+	s.firstSeen = m.firstSeen
+	return s
+}
+
+// stdDev returns population standard deviation in tenths of degree
+func (m *measurement) stdDev() float64 {
+	n := float64(m.count)
+	mean := float64(m.sum) / n
+	variance := float64(m.sumSquares)/n - mean*mean
+	if variance <= 0 { // guard against rounding errors
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+func processFiles(filenames []string, opts *options) (map[string]*measurement, error) {
+	if len(filenames) == 1 {
+		return processFile(filenames[0], opts)
+	}
+	if opts.sort != "first-seen" {
+		return processShared(filenames, opts)
+	}
+
+	measurements := make(map[string]*measurement)
+	// offset of the next file keeps first-seen order of stations across files
+	offset := int64(0)
+	for _, filename := range filenames {
+		fm, err := processFile(filename, opts)
+		if err != nil {
+			return nil, err
+		}
+		next := offset
+		for _, m := range fm {
+			m.firstSeen += offset
+			next = max(next, m.firstSeen+1)
+		}
+		offset = next
+		mergeMeasurements(measurements, fm)
+	}
+	return measurements, nil
+}
+
+// processShared aggregates files mapping all of them into memory and processing their chunks
+// by a single pool of workers so that small files do not limit parallelism.
+// Files that can not be mapped are streamed or read and processed one by one
+// so that at most one of them is held in memory. Errors are prefixed by the file name.
+func processShared(filenames []string, opts *options) (_ map[string]*measurement, err error) {
+	measurements := make(map[string]*measurement)
+	var parts [][]byte
+	var names []string
+	for _, filename := range filenames {
+		if filename == "-" {
+			fm, err := processStream(os.Stdin, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			mergeMeasurements(measurements, fm)
+			continue
+		}
+
+		f, size, stream, err := openInput(filename, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if stream {
+			fm, err := processStream(f, opts)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			mergeMeasurements(measurements, fm)
+			continue
+		}
+
+		// mapping stays valid after the file is closed
+		data, unmap, mapped, err := mapData(f, size, opts)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if !mapped {
+			fm, err := process(data, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			mergeMeasurements(measurements, fm)
+			continue
+		}
+		defer func() {
+			if uerr := unmap(); uerr != nil && err == nil {
+				err = fmt.Errorf("%s: %w", filename, uerr)
+			}
+		}()
+		parts = append(parts, data)
+		names = append(names, filename)
+	}
+
+	fm, err := processParts(parts, names, opts)
+	if err != nil {
+		return nil, err
+	}
+	mergeMeasurements(measurements, fm)
+	return measurements, nil
+}
+
+func processFile(filename string, opts *options) (_ map[string]*measurement, err error) {
+	if filename == "-" {
+		return processStream(os.Stdin, opts)
+	}
+
+	f, size, stream, err := openInput(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if stream {
+		return processStream(f, opts)
+	}
+
+	data, unmap, _, err := mapData(f, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if uerr := unmap(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	return process(data, opts)
 }
 
-func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("Missing measurements filename")
+// openInput opens the file and returns its size, stream is set if the file can not be mapped into memory.
+func openInput(filename string, opts *options) (_ *os.File, size int, stream bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, false, err
 	}
 
-	measurements := processFile(os.Args[1])
+	if fi.IsDir() {
+		return nil, 0, false, fmt.Errorf("not a regular file: %s", filename)
+	}
+	if !fi.Mode().IsRegular() {
+		// e.g. named pipe or device which can not be mmaped and has no size
+		return f, 0, true, nil
+	}
 
-	ids := make([]string, 0, len(measurements))
-	for id := range measurements {
-		ids = append(ids, id)
+	if fi.Size() < 0 || fi.Size() != int64(int(fi.Size())) {
+		return nil, 0, false, fmt.Errorf("invalid file size: %d", fi.Size())
 	}
-	sort.Strings(ids)
 
-	fmt.Print("{")
-	for i, id := range ids {
-		if i > 0 {
-			fmt.Print(", ")
-		}
-		m := measurements[id]
-		fmt.Printf("%s=%.1f/%.1f/%.1f", id, round(float64(m.min)/10.0), round(float64(m.sum)/10.0/float64(m.count)), round(float64(m.max)/10.0))
+	if opts.spill != nil {
+		// read sequentially to spill measurements of parts of the file
+		return f, 0, true, nil
+	}
+
+	// compressed file can not be mmaped and its size does not match processed bytes
+	if compressed, err := isCompressed(f); err != nil {
+		return nil, 0, false, err
+	} else if compressed {
+		return f, 0, true, nil
 	}
-	fmt.Println("}")
+	return f, int(fi.Size()), false, nil
 }
 
-func processFile(filename string) map[string]*measurement {
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Fatalf("Open: %v", err)
+// mapData maps the file of the size into memory or reads it if mmap is not supported,
+// mapped reports whether data was mapped.
+func mapData(f *os.File, size int, opts *options) (data []byte, unmap func() error, mapped bool, err error) {
+	if size == 0 {
+		// empty file is a valid empty dataset which can not be mmaped
+		return nil, func() error { return nil }, true, nil
 	}
-	defer f.Close()
+	mapStart := time.Now()
+	data, unmap, err = mapFile(f, size)
+	mapped = err == nil
+	if !mapped {
+		// some filesystems and platforms do not support mmap, read the whole file instead
+		data = make([]byte, size)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return nil, nil, false, err
+		}
+		unmap = func() error { return nil }
+	} else if !opts.noAdvise {
+		// advice is only a hint so processing does not depend on its result
+		_ = adviseSequential(data)
+	}
+	opts.timePhase("mmap", mapStart)
 
-	fi, err := f.Stat()
-	if err != nil {
-		log.Fatalf("Stat: %v", err)
+	if opts.progress != nil {
+		start, end := opts.window(data)
+		opts.progress.total.Add(int64(end - start))
 	}
+	return data, unmap, mapped, nil
+}
+
+// byteRange reports whether processing is restricted to a byte range of files.
+func (opts *options) byteRange() bool {
+	return opts.offset > 0 || opts.length > 0
+}
 
-	size := fi.Size()
-	if size <= 0 || size != int64(int(size)) {
-		log.Fatalf("Invalid file size: %d", size)
+// window returns the start and end of the byte range of data to process.
+// Like chunks, the range contains lines that start within [offset, offset+length)
+// so that adjacent ranges split a file without gaps or overlaps.
+func (opts *options) window(data []byte) (start, end int) {
+	if !opts.byteRange() {
+		return 0, len(data)
+	}
+	start, end = lineStart(data, opts.offset), len(data)
+	if opts.length > 0 && opts.offset < int64(len(data))-opts.length {
+		end = lineStart(data, opts.offset+opts.length)
 	}
+	return start, max(start, end)
+}
 
-	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
-	if err != nil {
-		log.Fatalf("Mmap: %v", err)
+// lineStart returns offset of the first line of data that starts at or after the offset.
+func lineStart(data []byte, offset int64) int {
+	if offset <= 0 {
+		return 0
+	}
+	if offset >= int64(len(data)) {
+		return len(data)
+	}
+	if data[offset-1] == '\n' {
+		return int(offset)
 	}
+	if i := bytes.IndexByte(data[offset:], '\n'); i >= 0 {
+		return int(offset) + i + 1
+	}
+	return len(data)
+}
+
+// mapFile is a variable to simulate mmap failures in tests.
+var mapFile = mmapFile
+
+// chunksPerWorker is the number of chunks per worker of process, a variable to compare in benchmarks.
+var chunksPerWorker = 4
 
+// process aggregates measurements of data splitting it into chunks processed in parallel.
+// If some chunks fail it returns measurements of the other chunks along with the error.
+func process(data []byte, opts *options) (map[string]*measurement, error) {
+	if len(data) == 0 {
+		return make(map[string]*measurement), nil
+	}
+	return processParts([][]byte{data}, nil, opts)
+}
+
+// processParts is like process but splits every part of data into chunks processed by the same workers.
+// Errors of chunks are prefixed by names of their parts if names are not nil.
+func processParts(parts [][]byte, names []string, opts *options) (_ map[string]*measurement, err error) {
+	// access to truncated mmaped file panics instead of crashing, see debug.SetPanicOnFault
+	defer rtdebug.SetPanicOnFault(rtdebug.SetPanicOnFault(true))
 	defer func() {
-		if err := syscall.Munmap(data); err != nil {
-			log.Fatalf("Munmap: %v", err)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("read fault: %v", r)
 		}
 	}()
 
-	return process(data)
+	// chunks keep offsets within the whole part to report lines at file offsets
+	windows := make([][2]int, len(parts))
+	total := 0
+	for p, data := range parts {
+		start, end := opts.window(data)
+		windows[p] = [2]int{start, end}
+		total += end - start
+	}
+
+	type chunk struct{ i, part, start, end int }
+	var all []chunk
+	chunkStart := time.Now()
+	for p, data := range parts {
+		data = data[windows[p][0]:windows[p][1]]
+		if len(data) == 0 {
+			continue
+		}
+		chunks := splitChunks(data, opts.numChunks(len(data), total))
+		if opts.dumpChunks {
+			if err := dumpChunks(opts.diagnostics(), data, windows[p][0], chunks); err != nil {
+				return nil, err
+			}
+		}
+		start := 0
+		for _, end := range chunks {
+			all = append(all, chunk{len(all), p, windows[p][0] + start, windows[p][0] + end})
+			start = end
+		}
+	}
+	opts.timePhase("chunk", chunkStart)
+	if len(all) == 0 {
+		return make(map[string]*measurement), nil
+	}
+	nWorkers := min(opts.numWorkers(), len(all))
+
+	if opts.shuffle {
+		r := rand.New(rand.NewSource(opts.shuffleSeed))
+		r.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	}
+	work := make(chan chunk, len(all))
+	for _, c := range all {
+		work <- c
+	}
+	close(work)
+
+	processStart := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(nWorkers)
+
+	// every worker adds its chunks into its own table
+	results := make([]*table, nWorkers)
+	errs := make([]error, len(all))
+	var mu sync.Mutex
+	var merged map[string]*measurement
+	if opts.incrementalMerge {
+		merged = make(map[string]*measurement, opts.stations)
+	}
+	var chunkResults []map[string]*measurement
+	if opts.chunkResults != nil {
+		chunkResults = make([]map[string]*measurement, len(all))
+	}
+	for w := range results {
+		go func(w int) {
+			rtdebug.SetPanicOnFault(true)
+			t := newChunkTable(opts)
+			for c := range work {
+				if err := processChunkRecover(t, parts[c.part][c.start:c.end], c.start, opts); err != nil && names != nil {
+					errs[c.i] = fmt.Errorf("%s: %w", names[c.part], err)
+				} else if err != nil {
+					errs[c.i] = err
+				}
+				if opts.chunkResults != nil {
+					chunkResults[c.i] = make(map[string]*measurement)
+					copyMeasurements(chunkResults[c.i], t)
+					t.reset()
+				} else if opts.incrementalMerge {
+					mu.Lock()
+					copyMeasurements(merged, t)
+					mu.Unlock()
+					t.reset()
+				}
+			}
+			if !opts.incrementalMerge && opts.chunkResults == nil {
+				results[w] = t
+			}
+			wg.Done()
+		}(w)
+	}
+	wg.Wait()
+	opts.timePhase("process", processStart)
+
+	// all workers fail on cancellation, return the context error once
+	if opts.ctx != nil && opts.ctx.Err() != nil {
+		return nil, opts.ctx.Err()
+	}
+	if opts.chunkResults != nil {
+		*opts.chunkResults = chunkResults
+		return make(map[string]*measurement), errors.Join(errs...)
+	}
+	measurements := merged
+	if !opts.incrementalMerge {
+		mergeStart := time.Now()
+		measurements = mergeTables(results, runtime.NumCPU())
+		opts.timePhase("merge", mergeStart)
+	}
+
+	// return measurements of the other chunks if some failed
+	return measurements, errors.Join(errs...)
 }
 
-func process(data []byte) map[string]*measurement {
-	nChunks := runtime.NumCPU()
+// numWorkers returns the number of goroutines processing chunks.
+func (opts *options) numWorkers() int {
+	if opts.workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return opts.workers
+}
 
-	chunkSize := len(data) / nChunks
-	if chunkSize == 0 {
-		chunkSize = len(data)
+// numChunks returns the number of chunks to split data of the size into,
+// a part of the total size of all data processed by the workers.
+func (opts *options) numChunks(size, total int) int {
+	// more chunks than workers balance the load when some regions of data are slower to process,
+	// there is no point to have more chunks than bytes
+	n := (opts.numWorkers()*chunksPerWorker*size + total - 1) / total
+	if opts.chunkBytes > 0 {
+		n = (size + opts.chunkBytes - 1) / opts.chunkBytes
 	}
+	return max(min(n, size), 1)
+}
+
+// needsSlowPath reports whether lines are parsed one by one by parseLines
+// instead of the specialized parse of the reference format.
+func (opts *options) needsSlowPath() bool {
+	return opts.strict ||
+		opts.tempFilter ||
+		opts.maxAbsTemp > 0 ||
+		opts.valueFirst ||
+		opts.ignoreComments ||
+		opts.allowExponent ||
+		opts.withTimestamp ||
+		opts.missingValues == "zero" ||
+		opts.missingValues == "error" ||
+		opts.sort == "first-seen" ||
+		// names are normalized, see normalizer
+		opts.normalize != "" ||
+		opts.escape ||
+		opts.groupSep != ""
+}
+
+// processChunkRecover is like processChunkInto but returns error on panic, e.g. on read fault.
+func processChunkRecover(measurements *table, data []byte, offset int, opts *options) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("chunk at offset %d: panic: %v", offset, r)
+		}
+	}()
+	return chunkProcessor(measurements, data, offset, opts)
+}
+
+// chunkProcessor is a variable to simulate chunk failures in tests.
+var chunkProcessor = processChunkInto
 
-	chunks := make([]int, 0, nChunks)
+// splitChunks splits data into at most n chunks of similar size that end with a newline
+// except the last one that ends at the end of data. It returns chunk end offsets
+// such that every byte of data belongs to exactly one non-empty chunk.
+func splitChunks(data []byte, n int) []int {
+	chunkSize := max((len(data)+n-1)/n, 1)
+
+	chunks := make([]int, 0, n)
 	offset := 0
 	for offset < len(data) {
 		offset += chunkSize
@@ -88,159 +1348,491 @@ func process(data []byte) map[string]*measurement {
 			break
 		}
 
-		nlPos := bytes.IndexByte(data[offset:], '\n')
+		// search from the last byte of the chunk to keep chunk that already ends with newline
+		nlPos := bytes.IndexByte(data[offset-1:], '\n')
 		if nlPos == -1 {
 			chunks = append(chunks, len(data))
 			break
-		} else {
-			offset += nlPos + 1
-			chunks = append(chunks, offset)
 		}
+		offset += nlPos
+		chunks = append(chunks, offset)
 	}
+	return chunks
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(chunks))
-
-	results := make([]map[string]*measurement, len(chunks))
+// dumpChunks writes offsets of chunks and their first and last lines to w,
+// offsets are shifted by the offset of data in the file.
+func dumpChunks(w io.Writer, data []byte, offset int, chunks []int) error {
 	start := 0
-	for i, chunk := range chunks {
-		go func(data []byte, i int) {
-			results[i] = processChunk(data)
-			wg.Done()
-		}(data[start:chunk], i)
-		start = chunk
+	for i, end := range chunks {
+		chunk := bytes.TrimSuffix(data[start:end], []byte{'\n'})
+		first, _, _ := bytes.Cut(chunk, []byte{'\n'})
+		last := chunk[bytes.LastIndexByte(chunk, '\n')+1:]
+		if _, err := fmt.Fprintf(w, "chunk %d: %d-%d first %q last %q\n", i, offset+start, offset+end, first, last); err != nil {
+			return err
+		}
+		start = end
 	}
-	wg.Wait()
+	return nil
+}
 
-	measurements := make(map[string]*measurement)
-	for _, r := range results {
-		for id, rm := range r {
-			m := measurements[id]
-			if m == nil {
-				measurements[id] = rm
-			} else {
-				m.min = min(m.min, rm.min)
-				m.max = max(m.max, rm.max)
-				m.sum += rm.sum
-				m.count += rm.count
+// mergeTables merges chunk results in parallel.
+// It partitions stations by key between nParts goroutines so that each builds
+// a disjoint part of the result and then concatenates the parts.
+func mergeTables(tables []*table, nParts int) map[string]*measurement {
+	if debug {
+		// merge would combine duplicate entries of a station counting it twice
+		for i, t := range tables {
+			if id, ok := t.duplicateId(); ok {
+				panic(fmt.Sprintf("station %q has duplicate entries in chunk result %d", id, i))
 			}
 		}
 	}
+	if len(tables) == 1 {
+		return tables[0].result()
+	}
+
+	// the largest table is a lower bound of the number of stations
+	// that are evenly distributed between parts
+	stations := 0
+	for _, t := range tables {
+		stations = max(stations, t.size)
+	}
+
+	parts := make([]map[string]*measurement, nParts)
+
+	var wg sync.WaitGroup
+	wg.Add(nParts)
+	for p := range parts {
+		go func(p uint64) {
+			part := make(map[string]*measurement, stations/nParts)
+			for _, t := range tables {
+				for i := range t.entries {
+					e := &t.entries[i]
+					// check the key first as other goroutines update entries of their parts
+					if e.key%uint64(nParts) == p && e.count != 0 {
+						mergeMeasurement(part, e.id, &e.measurement)
+					}
+				}
+			}
+			parts[p] = part
+			wg.Done()
+		}(uint64(p))
+	}
+	wg.Wait()
+
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	measurements := make(map[string]*measurement, n)
+	for _, part := range parts {
+		maps.Copy(measurements, part)
+	}
 	return measurements
 }
 
-func processChunk(data []byte) map[string]*measurement {
-	// use uint64 FNV-1a hash of id value as buckets key and keep mapping to the id value.
-	// This assumes no collisions of id hashes.
-	const (
-		// use power of 2 for fast modulo calculation
-		nBuckets = 1 << 12
-		maxIds   = 10_000
-
-		fnv1aOffset64 = 14695981039346656037
-		fnv1aPrime64  = 1099511628211
-	)
-
-	type entry struct {
-		key uint64
-		mid int
-	}
-	buckets := make([][]entry, nBuckets)
-	measurements := make([]measurement, 0, maxIds)
-	ids := make(map[uint64][]byte)
-
-	getMeasurement := func(key uint64) *measurement {
-		i := key & uint64(nBuckets-1)
-		for j := 0; j < len(buckets[i]); j++ {
-			e := &buckets[i][j]
-			if e.key == key {
-				return &measurements[e.mid]
+// mergeMeasurements adds src measurements into dst taking ownership of src values.
+func mergeMeasurements(dst, src map[string]*measurement) {
+	for id, rm := range src {
+		if m := dst[id]; m == nil {
+			dst[id] = rm
+		} else {
+			m.merge(rm)
+		}
+	}
+}
+
+// copyMeasurements adds measurements of the table into dst copying them
+// so that the table can be reset and reused.
+func copyMeasurements(dst map[string]*measurement, t *table) {
+	for i := range t.entries {
+		e := &t.entries[i]
+		if e.count == 0 {
+			continue
+		}
+		if m := dst[string(e.id)]; m == nil {
+			m := e.measurement
+			dst[string(e.id)] = &m
+		} else {
+			m.merge(&e.measurement)
+		}
+	}
+}
+
+// mergeMeasurement adds station measurement into dst taking ownership of it.
+func mergeMeasurement(dst map[string]*measurement, id []byte, rm *measurement) {
+	if m := dst[string(id)]; m == nil {
+		dst[string(id)] = rm
+	} else {
+		m.merge(rm)
+	}
+}
+
+func (m *measurement) merge(o *measurement) {
+	m.update(o.min, o.max, o.sum, o.count, o.sumSquares)
+	if o.hist != nil {
+		if m.hist == nil {
+			m.hist = o.hist
+		} else {
+			m.hist.merge(o.hist)
+		}
+	}
+	if o.span != nil {
+		if m.span == nil {
+			m.span = o.span
+		} else {
+			m.span.merge(o.span)
+		}
+	}
+	m.firstSeen = min(m.firstSeen, o.firstSeen)
+}
+
+// update combines aggregated values of measurements into m.
+// It is shared by adding of a single temperature and merging of chunk results.
+func (m *measurement) update(minTemp, maxTemp, sum, count, sumSquares int64) {
+	m.min = min(m.min, minTemp)
+	m.max = max(m.max, maxTemp)
+	m.sum += sum
+	m.count += count
+	m.sumSquares += sumSquares
+}
+
+// processChunk aggregates measurements of data located at offset of the input.
+func processChunk(data []byte, offset int, opts *options) (*table, error) {
+	measurements := newChunkTable(opts)
+	if err := processChunkInto(measurements, data, offset, opts); err != nil {
+		return nil, err
+	}
+	return measurements, nil
+}
+
+func newChunkTable(opts *options) *table {
+	t := newTable(opts.stations)
+	t.histograms = opts.percentiles
+	return t
+}
+
+// processChunkInto is like processChunk but adds measurements into the existing table.
+func processChunkInto(measurements *table, data []byte, offset int, opts *options) error {
+	delimiter := opts.delimiter
+	if delimiter == 0 {
+		delimiter = ';'
+	}
+	norm := opts.normalizer()
+
+	// process data in blocks to report progress and check cancellation
+	for len(data) > 0 {
+		if opts.ctx != nil {
+			if err := opts.ctx.Err(); err != nil {
+				return err
 			}
 		}
-		return nil
+
+		block := data
+		if len(block) > blockSize {
+			if nlPos := bytes.IndexByte(data[blockSize:], '\n'); nlPos != -1 {
+				block = data[:blockSize+nlPos+1]
+			}
+		}
+		if opts.limit != nil {
+			if block = opts.limit.take(block); len(block) == 0 {
+				return nil
+			}
+		}
+
+		if opts.endings != nil {
+			opts.endings.count(block)
+		}
+		if opts.lines != nil {
+			opts.lines.Add(countLines(block))
+		}
+		if opts.dryRun != nil {
+			opts.dryRun.check(block, offset, delimiter, opts)
+		} else if opts.needsSlowPath() {
+			if err := parseLines(measurements, block, offset, delimiter, opts, norm); err != nil {
+				return err
+			}
+		} else {
+			parse(measurements, block, delimiter)
+		}
+
+		data = data[len(block):]
+		offset += len(block)
+		if opts.progress != nil {
+			opts.progress.processed.Add(int64(len(block)))
+		}
+	}
+	return nil
+}
+
+// countLines returns the number of lines in data including the last unterminated one.
+func countLines(data []byte) int64 {
+	n := int64(bytes.Count(data, []byte{'\n'}))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// blockSize is the approximate size of data processed between progress updates
+// and cancellation checks.
+const blockSize = 1 << 20
+
+// hashId returns hash of station id used as table key.
+// It is specialized for short ids and processes 8 bytes at a time,
+// parse calculates the same hash while searching for the delimiter.
+func hashId(id []byte) uint64 {
+	h := uint64(hashSeed)
+	for ; len(id) >= 8; id = id[8:] {
+		h = (h ^ binary.LittleEndian.Uint64(id)) * hashPrime
 	}
 
-	putMeasurement := func(key uint64, m measurement) {
-		i := key & uint64(nBuckets-1)
-		buckets[i] = append(buckets[i], entry{key: key, mid: len(measurements)})
-		measurements = append(measurements, m)
+	var tail uint64
+	for i, b := range id {
+		tail |= uint64(b) << (8 * i)
 	}
+	return hashFinish(h, tail)
+}
+
+const (
+	hashSeed  = 0xcbf29ce484222325
+	hashPrime = 0x9e3779b97f4a7c15
+)
+
+// hashFinish adds the last, possibly zero, word of id to the hash h.
+func hashFinish(h, tail uint64) uint64 {
+	h = (h ^ tail) * hashPrime
+	// mix high bits into low bits used for table index
+	return h ^ h>>32
+}
 
-	// assume valid input
+// parse adds measurements of data lines into the table.
+// It scans each line once: searches for the delimiter while hashing the id
+// and locates the line end by the number format, see BenchmarkParse.
+func parse(measurements *table, data []byte, delimiter byte) {
+	// assume valid input, a line without delimiter becomes a part of the next station name
+	// so that -strict is needed to detect it
 	for len(data) > 0 {
+		// skip empty lines
+		if data[0] == '\n' || data[0] == '\r' {
+			data = data[1:]
+			continue
+		}
 
-		idHash := uint64(fnv1aOffset64)
-		semiPos := 0
-		for i, b := range data {
-			if b == ';' {
-				semiPos = i
+		// search for delimiter and hash id 8 bytes at a time, see hashId
+		semiPos := -1
+		idHash := uint64(hashSeed)
+		for i := 0; i+8 <= len(data); i += 8 {
+			word := binary.LittleEndian.Uint64(data[i:])
+			// set high bit of bytes equal to delimiter, see "Determine if a word has a zero byte"
+			// from https://graphics.stanford.edu/~seander/bithacks.html#ZeroInWord,
+			// lower bits are exact while bytes above the first match may be false positives
+			x := word ^ (0x0101010101010101 * uint64(delimiter))
+			if found := (x - 0x0101010101010101) &^ x & 0x8080808080808080; found != 0 {
+				n := bits.TrailingZeros64(found) >> 3
+				semiPos = i + n
+				idHash = hashFinish(idHash, word&(1<<(8*n)-1))
 				break
 			}
-
-			// calculate FNV-1a hash
-			idHash ^= uint64(b)
-			idHash *= fnv1aPrime64
+			idHash = (idHash ^ word) * hashPrime
+		}
+		if semiPos == -1 {
+			// less than 8 bytes left
+			if semiPos = bytes.IndexByte(data, delimiter); semiPos == -1 {
+				break
+			}
+			idHash = hashId(data[:semiPos])
 		}
 
 		idData := data[:semiPos]
 
 		data = data[semiPos+1:]
 
-		var temp int64
-		// parseNumber
-		{
-			negative := data[0] == '-'
-			if negative {
-				data = data[1:]
+		if len(data) >= 8 {
+			if temp, n, ok := parseNumberWord(binary.LittleEndian.Uint64(data)); ok {
+				measurements.add(idHash, idData, temp)
+				data = skipLineEnd(data[n:])
+				continue
 			}
-
-			_ = data[3]
-			if data[1] == '.' {
-				// 1.2\n
-				temp = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
-				data = data[4:]
-				// 12.3\n
+		}
+		if len(data) == 0 || data[0] == 'N' || data[0] == '\n' || data[0] == '\r' {
+			// skip missing value, i.e. NaN or empty, see -missing-values
+			if nlPos := bytes.IndexByte(data, '\n'); nlPos != -1 {
+				data = data[nlPos+1:]
 			} else {
-				_ = data[4]
-				temp = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
-				data = data[5:]
+				data = nil
 			}
+			continue
+		}
+		var temp int64
+		temp, data = parseNumberLine(data)
+		measurements.add(idHash, idData, temp)
+	}
+}
 
-			if negative {
-				temp = -temp
-			}
+// parseLines is the line by line alternative to parse that validates lines in strict mode,
+// supports value first records, exponents, timestamps and missing values, skips comments, filters temperatures and normalizes station names if norm is not nil.
+// It returns an error on the first malformed line in strict mode and skips it otherwise.
+func parseLines(measurements *table, data []byte, offset int, delimiter byte, opts *options, norm *normalizer) error {
+	for len(data) > 0 {
+		line := data
+		if nlPos := bytes.IndexByte(data, '\n'); nlPos != -1 {
+			line, data = data[:nlPos], data[nlPos+1:]
+		} else {
+			data = nil
+		}
+		lineOffset := offset
+		offset += len(line) + 1
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if opts.ignoreComments && isComment(line) {
+			continue
 		}
 
-		m := getMeasurement(idHash)
-		if m == nil {
-			putMeasurement(idHash, measurement{
-				min:   temp,
-				max:   temp,
-				sum:   temp,
-				count: 1,
-			})
-			ids[idHash] = idData
+		var idData, value []byte
+		var ok bool
+		if opts.escape {
+			idData, value, ok = cutEscaped(line, delimiter)
 		} else {
-			m.min = min(m.min, temp)
-			m.max = max(m.max, temp)
-			m.sum += temp
-			m.count++
+			idData, value, ok = bytes.Cut(line, []byte{delimiter})
+		}
+		if opts.valueFirst {
+			idData, value = value, idData
+		}
+		var ts int64
+		hasTimestamp := false
+		if ok && opts.withTimestamp {
+			// timestamp is the last column that follows the station name of value first records
+			if opts.valueFirst {
+				idData, ts, hasTimestamp, ok = cutTimestamp(idData, delimiter)
+			} else {
+				value, ts, hasTimestamp, ok = cutTimestamp(value, delimiter)
+			}
+		}
+		var temp int64
+		if ok && isMissingValue(value) && (opts.missingValues != "" || !opts.strict) {
+			switch opts.missingValues {
+			case "zero":
+				// temp is zero
+			case "error":
+				return fmt.Errorf("missing value at offset %d: %q", lineOffset, line)
+			default:
+				continue
+			}
+		} else if ok && opts.allowExponent && bytes.ContainsAny(value, "eE") {
+			var err error
+			temp, err = parseDegrees(string(value))
+			if errors.Is(err, errDegreesRange) && opts.maxAbsTemp > 0 {
+				return fmt.Errorf("temperature out of bounds at offset %d: %q", lineOffset, line)
+			}
+			ok = err == nil
+		} else if ok && opts.maxAbsTemp > 0 && (!opts.strict || isValidNumber(value)) {
+			// parseNumber wraps long numbers around which could bring them within the bound
+			if temp, ok = parseNumberExact(value); !ok {
+				return fmt.Errorf("temperature out of bounds at offset %d: %q", lineOffset, line)
+			}
+		} else if ok && (!opts.strict || isValidNumber(value)) {
+			temp = parseNumber(value)
+		} else {
+			ok = false
+		}
+		if !ok {
+			if opts.strict {
+				return fmt.Errorf("malformed line at offset %d: %q", lineOffset, line)
+			}
+			continue
 		}
-	}
 
-	result := make(map[string]*measurement, len(measurements))
-	for _, bucket := range buckets {
-		for _, entry := range bucket {
-			result[string(ids[entry.key])] = &measurements[entry.mid]
+		if opts.maxAbsTemp > 0 && (temp < -opts.maxAbsTemp || temp > opts.maxAbsTemp) {
+			return fmt.Errorf("temperature out of bounds at offset %d: %q", lineOffset, line)
+		}
+		if opts.tempFilter && (temp < opts.minTemp || temp > opts.maxTemp) {
+			continue
+		}
+
+		if norm != nil {
+			idData = norm.normalize(idData)
+		}
+		key := hashId(idData)
+		measurements.add(key, idData, temp)
+		if hasTimestamp || opts.sort == "first-seen" {
+			// look up the entry again as adding may grow the table
+			e := measurements.get(key&keyMask, idData)
+			if hasTimestamp {
+				e.addTimestamp(ts)
+			}
+			// chunks of a table may be processed in any order, keep the earliest offset
+			if opts.sort == "first-seen" {
+				if e.count == 1 {
+					e.firstSeen = int64(lineOffset)
+				} else {
+					e.firstSeen = min(e.firstSeen, int64(lineOffset))
+				}
+			}
 		}
 	}
-	return result
+	return nil
+}
+
+// isMissingValue reports whether the value is NaN or empty.
+func isMissingValue(value []byte) bool {
+	return len(value) == 0 || string(value) == "NaN"
+}
+
+// isComment reports whether the first non-whitespace byte of the line is '#'.
+func isComment(line []byte) bool {
+	line = bytes.TrimLeft(line, " \t")
+	return len(line) > 0 && line[0] == '#'
+}
+
+// enableTempFilter enables filtering of temperatures with unbounded range
+// to be narrowed by setting minTemp and maxTemp.
+func (opts *options) enableTempFilter() {
+	if !opts.tempFilter {
+		opts.tempFilter = true
+		opts.minTemp, opts.maxTemp = math.MinInt64, math.MaxInt64
+	}
+}
+
+// errDegreesRange is returned by parseDegrees for values beyond int64 tenths of degree.
+var errDegreesRange = errors.New("must be within int64 range of tenths of degree")
+
+// parseDegrees parses temperature in degrees into tenths of degree.
+// Unlike parseNumber it accepts any floating-point number format.
+func parseDegrees(s string) (int64, error) {
+	temp, err := strconv.ParseFloat(s, 64)
+	if errors.Is(err, strconv.ErrRange) || math.IsInf(temp, 0) || math.Abs(temp)*10 >= math.MaxInt64 {
+		return 0, errDegreesRange
+	}
+	if err != nil || math.IsNaN(temp) {
+		return 0, errors.New("must be a number")
+	}
+	return int64(math.Round(temp * 10)), nil
+}
+
+// skipLineEnd skips \n or \r\n line ending.
+func skipLineEnd(data []byte) []byte {
+	if len(data) > 1 && data[0] == '\r' {
+		return data[2:]
+	}
+	return data[1:]
 }
 
+// round rounds x to one decimal like the reference implementation.
+// It never returns negative zero so that output does not contain -0.0.
 func round(x float64) float64 {
 	return roundJava(x*10.0) / 10.0
 }
 
+// roundTo rounds x to the number of decimals like round does to one decimal.
+func roundTo(x float64, decimals int) float64 {
+	if decimals == 1 {
+		return round(x)
+	}
+	scale := math.Pow10(decimals)
+	return roundJava(x*scale) / scale
+}
+
 // roundJava returns the closest integer to the argument, with ties
 // rounding to positive infinity, see java's Math.round
 func roundJava(x float64) float64 {
@@ -257,22 +1849,135 @@ func roundJava(x float64) float64 {
 	return t
 }
 
-// parseNumber reads decimal number that matches "^-?[0-9]{1,2}[.][0-9]" pattern,
-// e.g.: -12.3, -3.4, 5.6, 78.9 and return the value*10, i.e. -123, -34, 56, 789.
-func parseNumber(data []byte) int64 {
+// isValidNumber checks that data matches "^-?[0-9]{1,2}[.][0-9]$" pattern of the reference format.
+func isValidNumber(data []byte) bool {
+	if len(data) > 0 && data[0] == '-' {
+		data = data[1:]
+	}
+	if len(data) != 3 && len(data) != 4 {
+		return false
+	}
+	for i, b := range data {
+		if i == len(data)-2 {
+			if b != '.' {
+				return false
+			}
+		} else if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNumber reads decimal number that matches "^-?[0-9]+([.][0-9])?" pattern,
+// e.g.: -12.3, -3.4, 5.6, 78.9, 12, -7 and return the value*10, i.e. -123, -34, 56, 789, 120, -70.
+// parseNumberExact is like parseNumber but returns false if the value overflows int64.
+func parseNumberExact(data []byte) (int64, bool) {
+	negative := len(data) > 0 && data[0] == '-'
+	if negative {
+		data = data[1:]
+	}
+
+	var result int64
+	scale := int64(10)
+	for _, b := range data {
+		if b == '.' {
+			scale = 1
+			continue
+		}
+		// any byte is added as a digit like by parseNumber
+		if result > (math.MaxInt64-math.MaxUint8)/10 {
+			return 0, false
+		}
+		result = result*10 + int64(b) - '0'
+	}
+	if result > math.MaxInt64/scale {
+		return 0, false
+	}
+	result *= scale
+
+	if negative {
+		return -result, true
+	}
+	return result, true
+}
+
+// parseNumberLine parses number at the start of data and returns the next line.
+func parseNumberLine(data []byte) (int64, []byte) {
 	negative := data[0] == '-'
 	if negative {
 		data = data[1:]
 	}
 
+	var temp int64
+	if len(data) > 3 && data[1] == '.' {
+		// 1.2\n
+		temp = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
+		data = skipLineEnd(data[3:])
+	} else if len(data) > 4 && data[2] == '.' {
+		// 12.3\n
+		temp = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
+		data = skipLineEnd(data[4:])
+	} else {
+		// other formats, e.g. without decimal point
+		nlPos := bytes.IndexByte(data, '\n')
+		if nlPos == -1 {
+			nlPos = len(data)
+		}
+		temp = parseNumber(bytes.TrimSuffix(data[:nlPos], []byte{'\r'}))
+		data = data[min(nlPos+1, len(data)):]
+	}
+
+	if negative {
+		temp = -temp
+	}
+	return temp, data
+}
+
+// parseNumberWord parses number of -?d?d.d format at the start of the 8 byte little endian word
+// without branches like the fastest Java solutions of the challenge.
+// It returns the number in tenths and its length or false if the number has other format.
+func parseNumberWord(word uint64) (int64, int, bool) {
+	// bit 4 is set for digits and unset for '.' expected at byte 1, 2 or 3
+	dotBit := uint(bits.TrailingZeros64(^word & 0x10101000))
+	// -1 if the number is negative, 0 otherwise
+	sign := int64(^word<<59) >> 63
+	// no dot results in zero shifted word
+	if byte(word>>(dotBit&^7)) != '.' || int(dotBit>>3)+int(sign) > 2 {
+		return 0, 0, false
+	}
+
+	// clear the sign, align digits to bytes 2, 3 and 5 and convert them from ASCII
+	digits := ((word &^ uint64(sign&0xff)) << (28 - dotBit)) & 0x0f000f0f00
+	// multiply digits by 100, 10 and 1 and sum them up in bits 32..41
+	abs := int64((digits * 0x640a0001) >> 32 & 0x3ff)
+	return (abs ^ sign) - sign, int(dotBit>>3) + 2, true
+}
+
+func parseNumber(data []byte) int64 {
+	negative := len(data) > 0 && data[0] == '-'
+	if negative {
+		data = data[1:]
+	}
+
 	var result int64
-	switch len(data) {
+	switch {
 	// 1.2
-	case 3:
+	case len(data) == 3 && data[1] == '.':
 		result = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
 	// 12.3
-	case 4:
+	case len(data) == 4 && data[2] == '.':
 		result = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
+	default:
+		scale := int64(10)
+		for _, b := range data {
+			if b == '.' {
+				scale = 1
+			} else {
+				result = result*10 + int64(b) - '0'
+			}
+		}
+		result *= scale
 	}
 
 	if negative {
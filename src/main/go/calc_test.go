@@ -1,9 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestRoundJava(t *testing.T) {
@@ -32,23 +49,1362 @@ func TestRoundJava(t *testing.T) {
 func TestParseNumber(t *testing.T) {
 	for _, tc := range []struct {
 		value    string
-		expected string
+		expected int64
+	}{
+		{value: "-99.9", expected: -999},
+		{value: "-12.3", expected: -123},
+		{value: "-1.5", expected: -15},
+		{value: "-1.0", expected: -10},
+		{value: "-0.5", expected: -5},
+		{value: "-0.0", expected: 0},
+		{value: "0.0", expected: 0},
+		{value: "0.3", expected: 3},
+		{value: "12.3", expected: 123},
+		{value: "99.9", expected: 999},
+		{value: "5", expected: 50},
+		{value: "12", expected: 120},
+		{value: "-7", expected: -70},
+		{value: "123.4", expected: 1234},
+	} {
+		if number := parseNumber([]byte(tc.value)); number != tc.expected {
+			t.Errorf("Wrong parsing of %v, expected: %d, got: %d", tc.value, tc.expected, number)
+		}
+	}
+}
+
+func TestParseNumberShapes(t *testing.T) {
+	// every value of d.d, -d.d, dd.d and -dd.d shapes
+	for temp := -999; temp <= 999; temp++ {
+		value := fmt.Sprintf("%d.%d", temp/10, abs(temp%10))
+		if temp > -10 && temp < 0 {
+			value = "-" + value
+		}
+		if number := parseNumber([]byte(value)); number != int64(temp) {
+			t.Errorf("Wrong parsing of %v, expected: %d, got: %d", value, temp, number)
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func TestParseNumberWord(t *testing.T) {
+	values := []string{"-0.0"}
+	for temp := -999; temp <= 999; temp++ {
+		values = append(values, fmt.Sprintf("%.1f", float64(temp)/10))
+	}
+
+	for _, value := range values {
+		for _, lineEnd := range []string{"\n", "\r\n", "\nFoo;1.0\n"} {
+			data := []byte(value + lineEnd + "\x00\x00\x00\x00")
+			number, n, ok := parseNumberWord(binary.LittleEndian.Uint64(data))
+			if !ok || number != parseNumber([]byte(value)) || n != len(value) {
+				t.Errorf("Wrong parsing of %q, expected: %d, %d, got: %d, %d, %v", data, parseNumber([]byte(value)), len(value), number, n, ok)
+			}
+		}
+	}
+
+	for _, data := range []string{"12\nFoo;1.0\n", "123.4\nFoo;1.0\n", "-123.4\nFoo;1.0\n", "5\nFoo;12.3\n", "12345678"} {
+		if _, _, ok := parseNumberWord(binary.LittleEndian.Uint64([]byte(data))); ok {
+			t.Errorf("Unexpected parsing of %q", data)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	filename := writeTempFile(t, "Hamburg;12.0\nBulawayo;8.9\nHamburg;-3.4\nHamburg;34.2\n")
+
+	measurements, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// standard deviation is covered by TestStdDev
+	for id, s := range measurements {
+		s.StdDev = 0
+		measurements[id] = s
+	}
+
+	expected := Results{
+		"Bulawayo": {min: 8.9, max: 8.9, sum: 8.9, count: 1},
+		"Hamburg":  {min: -3.4, max: 34.2, sum: 42.8, count: 3},
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Errorf("Wrong aggregation, expected: %v, got: %v", expected, measurements)
+	}
+}
+
+func TestAggregateWithSink(t *testing.T) {
+	filename := writeTempFile(t, "Hamburg;12.0\nBulawayo;8.9\nHamburg;-3.4\nAbha;-1.0\nHamburg;34.2\n")
+
+	type call struct {
+		name string
+		s    Stats
+	}
+	var calls []call
+	if err := AggregateWithSink(filename, func(name string, s Stats) {
+		calls = append(calls, call{name, s})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []call
+	for _, id := range []string{"Abha", "Bulawayo", "Hamburg"} {
+		expected = append(expected, call{id, results[id]})
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Wrong sink calls, expected: %v, got: %v", expected, calls)
+	}
+
+	if err := AggregateWithSink("testdata/missing.txt", func(string, Stats) {
+		t.Error("Unexpected sink call")
+	}); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestAggregateChunks(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+
+	defer func(f func(*os.File, int) ([]byte, func() error, error)) { mapFile = f }(mapFile)
+	mapped, unmapped := 0, 0
+	mapFile = func(f *os.File, size int) ([]byte, func() error, error) {
+		data, unmap, err := mmapFile(f, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		mapped++
+		return data, func() error {
+			unmapped++
+			return unmap()
+		}, nil
+	}
+
+	chunks, err := AggregateChunks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped != 1 || unmapped != 1 {
+		t.Errorf("Expected the file to be mapped once, mapped: %d, unmapped: %d", mapped, unmapped)
+	}
+	// there are at least chunksPerWorker chunks for a single worker
+	if len(chunks) < chunksPerWorker {
+		t.Errorf("Wrong number of chunks, expected at least: %d, got: %d", chunksPerWorker, len(chunks))
+	}
+
+	merged, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int64)
+	for _, chunk := range chunks {
+		for id, s := range chunk {
+			counts[id] += s.Count()
+		}
+	}
+	if len(counts) != len(merged) {
+		t.Errorf("Wrong number of stations in chunks, expected: %d, got: %d", len(merged), len(counts))
+	}
+	for id, s := range merged {
+		if counts[id] != s.Count() {
+			t.Errorf("Wrong %s count in chunks, expected: %d, got: %d", id, s.Count(), counts[id])
+		}
+	}
+
+	if chunks, err := AggregateChunks(writeTempFile(t, "")); err != nil || len(chunks) != 0 {
+		t.Errorf("Unexpected chunks of empty file: %v, %v", chunks, err)
+	}
+	if _, err := AggregateChunks("testdata/measurements-10000-unique-keys.txt.bz2"); err == nil {
+		t.Error("Expected error for compressed file")
+	}
+}
+
+func TestRunByteRange(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ offset, length int64 }{
+		{offset: 0, length: 1000},
+		{offset: 1, length: 1000},
+		{offset: 12345, length: 54321},
+		{offset: 12345},
+		{offset: int64(len(data)) / 2, length: int64(len(data))},
+		{offset: int64(len(data)) - 1},
+		{offset: int64(len(data)) + 1, length: 10},
+		{length: 1},
+	} {
+		// the range contains lines that start within it
+		var extracted []byte
+		for lineStart := 0; lineStart < len(data); {
+			end := lineStart + bytes.IndexByte(data[lineStart:], '\n') + 1
+			if int64(lineStart) >= tc.offset && (tc.length == 0 || int64(lineStart) < tc.offset+tc.length) {
+				extracted = append(extracted, data[lineStart:end]...)
+			}
+			lineStart = end
+		}
+		var expected bytes.Buffer
+		if err := run([]string{writeTempFile(t, string(extracted))}, &options{}, &expected); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, workers := range []int{1, 3} {
+			var buf bytes.Buffer
+			opts := &options{workers: workers, chunkBytes: 4 << 10, offset: tc.offset, length: tc.length}
+			if err := run([]string{filename}, opts, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != expected.String() {
+				t.Errorf("Wrong output of range %d+%d with %d workers, expected: %s, got: %s", tc.offset, tc.length, workers, expected.String(), buf.String())
+			}
+		}
+	}
+
+	// malformed lines are reported at file offsets and ignored outside of the range
+	input := writeTempFile(t, "Foo;x\nFoo;1.0\nBar;y\nBaz;2.0\n")
+	expected := `malformed line at offset 14: "Bar;y"`
+	if err := run([]string{input}, &options{strict: true, offset: 6, length: 10}, io.Discard); err == nil || err.Error() != expected {
+		t.Errorf("Wrong error, expected: %s, got: %v", expected, err)
+	}
+	var buf bytes.Buffer
+	if err := run([]string{input}, &options{strict: true, offset: 3, length: 4}, &buf); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "{Foo=1.0/1.0/1.0}\n" {
+		t.Errorf("Unexpected output: %s", buf.String())
+	}
+
+	if err := run([]string{"testdata/measurements-10000-unique-keys.txt.bz2"}, &options{offset: 10}, io.Discard); err == nil {
+		t.Error("Expected error for compressed file")
+	}
+	if err := run([]string{filename}, &options{length: 10, verify: true}, io.Discard); err == nil {
+		t.Error("Expected error for verification")
+	}
+}
+
+func TestAggregateWithoutDecimalPoint(t *testing.T) {
+	filename := writeTempFile(t, "Foo;12\nFoo;12.3\nBar;-7\nFoo;-7\nBar;5.5\nBar;5")
+
+	measurements, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, expected := range map[string]Stats{
+		"Foo": {min: -7.0, max: 12.3, sum: 17.3, count: 3},
+		"Bar": {min: -7.0, max: 5.5, sum: 3.5, count: 3},
+	} {
+		s := measurements[id]
+		if s.min != expected.min || s.max != expected.max || s.sum != expected.sum || s.count != expected.count {
+			t.Errorf("Wrong %s aggregation, expected: %v, got: %v", id, expected, s)
+		}
+	}
+}
+
+func TestStdDev(t *testing.T) {
+	filename := writeTempFile(t, "Foo;2.0\nFoo;4.0\nBar;1.0\nFoo;4.0\nFoo;4.0\nFoo;5.0\nBar;1.0\nFoo;5.0\nFoo;7.0\nFoo;9.0\n")
+
+	for _, workers := range []int{1, 3, 10} {
+		measurements, err := aggregate([]string{filename}, &options{workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// population standard deviation of 2, 4, 4, 4, 5, 5, 7, 9 is 2
+		if s := measurements["Foo"]; s.StdDev != 2.0 {
+			t.Errorf("Wrong Foo standard deviation with %d workers, expected: 2, got: %v", workers, s.StdDev)
+		}
+		if s := measurements["Bar"]; s.StdDev != 0.0 {
+			t.Errorf("Wrong Bar standard deviation with %d workers, expected: 0, got: %v", workers, s.StdDev)
+		}
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-20.txt"
+
+	expected, err := os.ReadFile("../../test/resources/samples/measurements-20.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "result.out")
+	// existing content is truncated
+	if err := os.WriteFile(output, bytes.Repeat([]byte("x"), 10_000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	if err := run([]string{filename}, &options{output: output}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(expected) {
+		t.Errorf("Wrong output, expected: %s, got: %s", expected, result)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Unexpected stdout: %s", stdout.String())
+	}
+}
+
+func TestRunStdout(t *testing.T) {
+	filename := writeTempFile(t, "Hamburg;12.0\nBulawayo;8.9\nPalembang;38.8\nHamburg;34.2\nSt. John's;15.2\nCracow;12.6\n")
+
+	var stdout writesCounter
+	if err := run([]string{filename}, &options{}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "{Bulawayo=8.9/8.9/8.9, Cracow=12.6/12.6/12.6, Hamburg=12.0/23.1/34.2, Palembang=38.8/38.8/38.8, St. John's=15.2/15.2/15.2}\n"
+	if stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+	if stdout.writes != 1 {
+		t.Errorf("Expected single write, got: %d", stdout.writes)
+	}
+}
+
+func TestRunDiagnostics(t *testing.T) {
+	filename := writeTempFile(t, "Hamburg;12.0\nBulawayo;8.9\nHamburg;34.2\n")
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{filename}, &options{summary: true, verify: true, stderr: &stderr}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "{Bulawayo=8.9/8.9/8.9, Hamburg=12.0/23.1/34.2}\n"
+	if stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+	if stderr.String() != "processed 3 lines, 2 stations\n" {
+		t.Errorf("Wrong diagnostics: %q", stderr.String())
+	}
+}
+
+func TestRunQuiet(t *testing.T) {
+	filename := writeTempFile(t, "Hamburg;12.0\nBulawayo;8.9\nHamburg;34.2\n")
+
+	var stdout, stderr bytes.Buffer
+	opts := &options{quiet: true, summary: true, verify: true, checksum: true, dumpChunks: true, stderr: &stderr}
+	if err := run([]string{filename}, opts, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Bulawayo=8.9/8.9/8.9, Hamburg=12.0/23.1/34.2}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("Unexpected diagnostics: %q", stderr.String())
+	}
+}
+
+type writesCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writesCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestRunEmptyFile(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := run([]string{writeTempFile(t, "")}, &options{}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout.String() != "{}\n" {
+		t.Errorf("Wrong output, expected: %q, got: %q", "{}\n", stdout.String())
+	}
+}
+
+func TestRunUnknownFormat(t *testing.T) {
+	if err := run([]string{"../../test/resources/samples/measurements-20.txt"}, &options{format: "xml"}, io.Discard); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestRunSmallFile(t *testing.T) {
+	// file is smaller than the number of workers
+	filename := writeTempFile(t, "Foo;1.0\nBar;-2.0\n")
+
+	for _, workers := range []int{0, 64, 1024} {
+		var stdout bytes.Buffer
+		if err := run([]string{filename}, &options{workers: workers}, &stdout); err != nil {
+			t.Fatal(err)
+		}
+
+		const expected = "{Bar=-2.0/-2.0/-2.0, Foo=1.0/1.0/1.0}\n"
+		if stdout.String() != expected {
+			t.Errorf("Wrong output with %d workers, expected: %q, got: %q", workers, expected, stdout.String())
+		}
+	}
+}
+
+func TestRunMultipleFiles(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := bytes.IndexByte(data[len(data)/2:], '\n') + len(data)/2 + 1
+
+	var expected bytes.Buffer
+	if err := run([]string{filename}, &options{}, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// both parts contain the same stations
+	filenames := []string{writeTempFile(t, string(data[:half])), writeTempFile(t, string(data[half:])), writeTempFile(t, "")}
+	var result bytes.Buffer
+	if err := run(filenames, &options{}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != expected.String() {
+		t.Errorf("Result of multiple files differs from the concatenated file, expected: %s, got: %s", expected.String(), result.String())
+	}
+}
+
+func TestProcessSharedFiles(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// many small files, an empty and a compressed one are processed by the same workers
+	var filenames []string
+	for _, part := range splitLines(data, 50) {
+		filenames = append(filenames, writeTempFile(t, string(part)))
+	}
+	filenames = append(filenames, writeTempFile(t, ""))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("Foo;1.0\nBar;2.0\n"))
+	zw.Close()
+	filenames = append(filenames, writeTempFile(t, gz.String()))
+
+	for _, opts := range []options{{workers: 1}, {workers: 4}, {workers: 4, incrementalMerge: true}, {workers: 4, chunkBytes: 1 << 10}} {
+		expected, err := processFile(writeTempFile(t, string(data)+"Foo;1.0\nBar;2.0\n"), &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		measurements, err := processFiles(filenames, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Result of %d files with %d workers differs from the concatenated file", len(filenames), opts.workers)
+		}
+	}
+
+	dir := t.TempDir()
+	if _, err := processFiles([]string{filenames[0], dir}, &options{}); err == nil || !strings.HasPrefix(err.Error(), dir+": ") {
+		t.Errorf("Expected error for directory %s, got: %v", dir, err)
+	}
+	malformed := writeTempFile(t, "Foo;1.0\nFoo;x\n")
+	expected := malformed + `: malformed line at offset 8: "Foo;x"`
+	if _, err := processFiles([]string{filenames[0], malformed}, &options{strict: true}); err == nil || err.Error() != expected {
+		t.Errorf("Wrong error, expected: %s, got: %v", expected, err)
+	}
+
+	// files that can not be mapped are read and processed one by one
+	mapped, err := processFiles(filenames, &options{workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var events []string
+	defer func(f func(*os.File, int) ([]byte, func() error, error)) { mapFile = f }(mapFile)
+	mapFile = func(*os.File, int) ([]byte, func() error, error) {
+		mu.Lock()
+		events = append(events, "read")
+		mu.Unlock()
+		return nil, nil, syscall.EINVAL
+	}
+	defer func(f func(*table, []byte, int, *options) error) { chunkProcessor = f }(chunkProcessor)
+	chunkProcessor = func(measurements *table, data []byte, offset int, opts *options) error {
+		mu.Lock()
+		events = append(events, "chunk")
+		mu.Unlock()
+		return processChunkInto(measurements, data, offset, opts)
+	}
+	measurements, err := processFiles(filenames, &options{workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(measurements, mapped) {
+		t.Error("Result of read files differs from mapped files")
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i-1] == "read" && events[i] == "read" {
+			t.Fatalf("File is read before the previous one is processed: %v", events)
+		}
+	}
+}
+
+// splitLines splits data into n parts at line boundaries.
+func splitLines(data []byte, n int) [][]byte {
+	var parts [][]byte
+	start := 0
+	for _, end := range splitChunks(data, n) {
+		parts = append(parts, data[start:end])
+		start = end
+	}
+	return parts
+}
+
+func TestReadManifest(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := bytes.IndexByte(data[len(data)/2:], '\n') + len(data)/2 + 1
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "shards"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	shard := filepath.Join(dir, "shards", "part-001.txt")
+	for name, content := range map[string][]byte{"shards/part-000.txt": data[:half], shard: data[half:]} {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		if err := os.WriteFile(name, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// relative and absolute paths
+	manifest := filepath.Join(dir, "manifest.txt")
+	if err := os.WriteFile(manifest, []byte("shards/part-000.txt\n\n"+shard+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join(dir, "shards", "part-000.txt"), shard}; !reflect.DeepEqual(filenames, expected) {
+		t.Errorf("Wrong manifest paths, expected: %v, got: %v", expected, filenames)
+	}
+
+	expected, err := aggregate([]string{filename}, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measurements, err := aggregate(filenames, &options{}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Result of manifest shards differs from the concatenated file")
+	}
+}
+
+func TestAggregateMissingFile(t *testing.T) {
+	if _, err := Aggregate(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestAggregateDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Aggregate(dir); err == nil || err.Error() != "not a regular file: "+dir {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAggregateMmapFallback(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+
+	expected, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f func(*os.File, int) ([]byte, func() error, error)) { mapFile = f }(mapFile)
+	mapFile = func(*os.File, int) ([]byte, func() error, error) {
+		return nil, nil, syscall.EINVAL
+	}
+
+	measurements, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Fallback result differs from mmap result")
+	}
+}
+
+func TestAggregateContext(t *testing.T) {
+	// larger than a single block
+	filename := writeMeasurements(t, 200_000, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := AggregateContext(ctx, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel after processing has started
+	if _, err := AggregateContext(cancelingContext{ctx, cancel}, filename); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled error, got: %v", err)
+	}
+
+	if _, err := AggregateContext(ctx, filename); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled error, got: %v", err)
+	}
+}
+
+func TestAggregateContextUnmap(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+
+	defer func(f func(*os.File, int) ([]byte, func() error, error)) { mapFile = f }(mapFile)
+	mapped, unmapped := 0, 0
+	mapFile = func(f *os.File, size int) ([]byte, func() error, error) {
+		data, unmap, err := mmapFile(f, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		mapped++
+		return data, func() error {
+			unmapped++
+			return unmap()
+		}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := AggregateContext(cancelingContext{ctx, cancel}, filename); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled error, got: %v", err)
+	}
+	if mapped != 1 || unmapped != 1 {
+		t.Errorf("Expected canceled processing to unmap the mapped file, mapped: %d, unmapped: %d", mapped, unmapped)
+	}
+}
+
+// cancelingContext cancels itself on the first Err call.
+type cancelingContext struct {
+	context.Context
+	cancel context.CancelFunc
+}
+
+func (c cancelingContext) Err() error {
+	err := c.Context.Err()
+	c.cancel()
+	return err
+}
+
+func TestProcessWorkers(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(n int) { chunksPerWorker = n }(chunksPerWorker)
+
+	chunksPerWorker = 1
+	expected := mustProcess(t, data, &options{workers: 1})
+	for _, n := range []int{1, 4, 16} {
+		chunksPerWorker = n
+		for _, workers := range []int{1, 2, 8, 1000} {
+			if measurements := mustProcess(t, data, &options{workers: workers}); !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("Result with %d workers and %d chunks per worker differs from single chunk result", workers, n)
+			}
+		}
+	}
+}
+
+func TestProcessFileShapes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := generateMeasurements(&buf, 1000, 1); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.String()
+	crlf := strings.ReplaceAll(data, "\n", "\r\n")
+
+	defer func(n int) { chunksPerWorker = n }(chunksPerWorker)
+	chunksPerWorker = 1
+
+	for _, tc := range []struct {
+		name, input string
+	}{
+		{"newline", data},
+		{"no newline", strings.TrimSuffix(data, "\n")},
+		{"empty last line", data + "\n"},
+		{"crlf", crlf},
+		{"crlf no newline", strings.TrimSuffix(crlf, "\r\n")},
+		{"single line", "Foo;1.2"},
+		{"single line newline", "Foo;-1.2\n"},
+	} {
+		expected, err := aggregateSerial(writeTempFile(t, tc.input), &options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for chunks := 1; chunks <= max(runtime.NumCPU(), 16); chunks++ {
+			if measurements := mustProcess(t, []byte(tc.input), &options{workers: chunks}); !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("%s: result of %d chunks differs from serial result", tc.name, chunks)
+			}
+		}
+	}
+}
+
+func TestProcessChunksWithoutRecords(t *testing.T) {
+	// long lines span boundaries of many chunks that end with the line so
+	// some chunks contain only a part of the line that belongs to the previous chunk
+	long := strings.Repeat("x", 1000)
+	input := "Foo;1.0\n" + long + ";2.0\nBar;2.0\n" + long + ";-2.0\n" + long + ";4.0\nFoo;3.0\n" + long + ";0.0"
+
+	expected := map[string]*measurement{
+		"Foo": {min: 10, max: 30, sum: 40, count: 2, sumSquares: 100 + 900},
+		"Bar": {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+		long:  {min: -20, max: 40, sum: 40, count: 4, sumSquares: 400 + 400 + 1600},
+	}
+	for _, workers := range []int{1, 2, 16, 1000} {
+		for _, opts := range []*options{{workers: workers}, {workers: workers, strict: true}} {
+			if measurements := mustProcess(t, []byte(input), opts); !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("Wrong aggregation with %+v, expected: %v, got: %v", *opts, expected, measurements)
+			}
+		}
+
+		// every chunk starts with a record and the chunks cover the whole input
+		start := 0
+		for _, end := range splitChunks([]byte(input), workers*chunksPerWorker) {
+			if chunk := input[start:end]; start > 0 && input[start-1] != '\n' || !strings.Contains(chunk, ";") {
+				t.Errorf("Chunk at %d does not contain a complete record: %q", start, chunk)
+			}
+			start = end
+		}
+		if start != len(input) {
+			t.Errorf("Chunks end at %d instead of %d", start, len(input))
+		}
+	}
+
+	// lines without delimiter are malformed
+	if _, err := process([]byte("Foo;1.0\n"+long+"\nBar;2.0\n"), &options{strict: true, workers: 16}); err == nil {
+		t.Error("Expected error for line without delimiter in strict mode")
+	}
+}
+
+func TestProcessDumpChunks(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stderr bytes.Buffer
+	measurements := mustProcess(t, data, &options{workers: 3, dumpChunks: true, stderr: &stderr})
+	if !reflect.DeepEqual(measurements, mustProcess(t, data, &options{workers: 3})) {
+		t.Error("Dumping chunks changes the result")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if len(lines) != 3*chunksPerWorker {
+		t.Fatalf("Wrong number of chunks, expected: %d, got: %d", 3*chunksPerWorker, len(lines))
+	}
+	offset := 0
+	for i, line := range lines {
+		var n, start, end int
+		var first, last string
+		if _, err := fmt.Sscanf(line, "chunk %d: %d-%d first %q last %q", &n, &start, &end, &first, &last); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if n != i || start != offset || end <= start {
+			t.Errorf("Chunk %q does not follow the previous one ending at %d", line, offset)
+		}
+		if !bytes.HasPrefix(data[start:], []byte(first+"\n")) || !bytes.HasSuffix(data[:end], []byte("\n"+last+"\n")) {
+			t.Errorf("Wrong first or last line of chunk %q", line)
+		}
+		offset = end
+	}
+	if offset != len(data) {
+		t.Errorf("Chunks end at %d instead of the end of data at %d", offset, len(data))
+	}
+}
+
+func TestProcessChunkBytes(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := mustProcess(t, data, &options{})
+	for _, chunkBytes := range []int{1, 100, 4096, len(data) - 1, len(data), 2 * len(data)} {
+		var stderr bytes.Buffer
+		opts := &options{workers: 3, chunkBytes: chunkBytes, dumpChunks: true, stderr: &stderr}
+		if measurements := mustProcess(t, data, opts); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Result with %d chunk bytes differs from the default one", chunkBytes)
+		}
+
+		// chunks end at the first newline after the chunk size so some may be skipped
+		if n, limit := strings.Count(stderr.String(), "\n"), (len(data)+chunkBytes-1)/chunkBytes; n < 1 || n > limit {
+			t.Errorf("Wrong number of chunks with %d chunk bytes, expected at most: %d, got: %d", chunkBytes, limit, n)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected int
+	}{
+		{"1", 1},
+		{"4096", 4096},
+		{"64K", 64 << 10},
+		{"64m", 64 << 20},
+		{"2G", 2 << 30},
+	} {
+		if n, err := parseSize(tc.value); err != nil || n != tc.expected {
+			t.Errorf("Wrong parsing of %s, expected: %d, got: %d, %v", tc.value, tc.expected, n, err)
+		}
+	}
+	for _, value := range []string{"", "0", "-1", "K", "1T", "1.5M"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestSplitChunks(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, input := range [][]byte{
+		data,
+		data[:len(data)-1], // no trailing newline
+		[]byte("Foo;1.0"),
+		[]byte("Foo;1.0\n"),
+		[]byte("\n\n\n\n\n\n\n\n"),
+		[]byte("Foo;1.0\nBar;2.0\n\n\nBaz;3.0"),
+	} {
+		for n := 1; n <= 64; n++ {
+			chunks := splitChunks(input, n)
+			if len(chunks) == 0 || len(chunks) > n {
+				t.Fatalf("Wrong number of chunks for n=%d: %v", n, chunks)
+			}
+
+			start := 0
+			for i, end := range chunks {
+				if end <= start {
+					t.Fatalf("Empty or overlapping chunk %d for n=%d: %v", i, n, chunks)
+				}
+				if end < len(input) && input[end-1] != '\n' {
+					t.Fatalf("Chunk %d does not end with newline for n=%d: %v", i, n, chunks)
+				}
+				start = end
+			}
+			if start != len(input) {
+				t.Fatalf("Chunks do not cover input of length %d for n=%d: %v", len(input), n, chunks)
+			}
+		}
+	}
+}
+
+func TestProcessLineCount(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected int64
+	}{
+		{input: "", expected: 0},
+		{input: "Foo;1.0", expected: 1},
+		{input: "Foo;12.3\n", expected: 1},
+		{input: "Foo;1.0\nBar;-2.0", expected: 2},
+		{input: "Foo;1.0\nBar;-12.0", expected: 2},
+		{input: "\n\n\n\n\n\n\n\n", expected: 0},
+		{input: "\r\n\r\n\r\n", expected: 0},
+		{input: "Foo;1.0\n\n\nBar;2.0\n\nBaz;3\n\n", expected: 3},
+		{input: "Foo;1.0\r\n\r\nBar;2.0\r\n", expected: 2},
+	} {
+		for workers := 1; workers <= 16; workers++ {
+			measurements := mustProcess(t, []byte(tc.input), &options{workers: workers})
+
+			lines := int64(0)
+			for _, m := range measurements {
+				lines += m.count
+			}
+			if lines != tc.expected {
+				t.Errorf("Wrong line count of %q with %d workers, expected: %d, got: %d", tc.input, workers, tc.expected, lines)
+			}
+		}
+	}
+}
+
+func TestMergeTables(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := bytes.IndexByte(data[len(data)/2:], '\n') + len(data)/2 + 1
+
+	newTables := func() []*table {
+		var tables []*table
+		// overlapping stations
+		for _, chunk := range [][]byte{data, data[:half], data[half:]} {
+			tb, err := processChunk(chunk, 0, &options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tables = append(tables, tb)
+		}
+		return tables
+	}
+
+	expected := make(map[string]*measurement)
+	for _, tb := range newTables() {
+		mergeMeasurements(expected, tb.result())
+	}
+
+	for _, nParts := range []int{1, 3, 8} {
+		if measurements := mergeTables(newTables(), nParts); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Result of merge with %d parts differs from serial merge", nParts)
+		}
+	}
+}
+
+func TestProcessMergeOverlapping(t *testing.T) {
+	// every chunk has Foo and Bar
+	const input = "Foo;1.0\nBar;-2.0\n" + "Foo;-5.5\nBar;3.0\n" + "Foo;7.5\nBar;-2.0\n" + "Bar;0.0\nFoo;0.0\n"
+
+	expected := map[string]*measurement{
+		"Foo": {min: -55, max: 75, sum: 30, count: 4, sumSquares: 100 + 3025 + 5625},
+		"Bar": {min: -20, max: 30, sum: -10, count: 4, sumSquares: 400 + 900 + 400},
+	}
+	for _, workers := range []int{1, 2, 4} {
+		if measurements := mustProcess(t, []byte(input), &options{workers: workers}); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong merge of overlapping stations with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
+	}
+}
+
+func TestProcessIncrementalMerge(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every chunk has Foo and Bar
+	overlapping := []byte(strings.Repeat("Foo;1.0\nBar;-2.0\nFoo;-5.5\nBar;3.0\n", 16))
+
+	for _, data := range [][]byte{data, overlapping} {
+		for _, opts := range []options{{workers: 1}, {workers: 4}, {workers: 16, chunkBytes: 64}, {workers: 4, percentiles: true}} {
+			expected := mustProcess(t, data, &opts)
+			opts.incrementalMerge = true
+			if measurements := mustProcess(t, data, &opts); !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("Incremental merge with %d workers differs from parallel merge", opts.workers)
+			}
+		}
+	}
+}
+
+func TestProcessShuffle(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first-seen offsets do not depend on the order of chunks either
+	for _, sort := range []string{"", "first-seen"} {
+		expected := mustProcess(t, data, &options{workers: 4, chunkBytes: 4 << 10, sort: sort})
+		for seed := range int64(5) {
+			measurements := mustProcess(t, data, &options{workers: 4, chunkBytes: 4 << 10, sort: sort, shuffle: true, shuffleSeed: seed})
+			if !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("Wrong aggregation with shuffle seed %d and sort %q", seed, sort)
+			}
+		}
+	}
+
+	// stations reappear in different order in every chunk processed by the same worker
+	var lines strings.Builder
+	for i := range 200 {
+		for j := range 7 {
+			fmt.Fprintf(&lines, "Station%d;%d.0\n", (i*j+i)%11, j)
+		}
+	}
+	filename := writeTempFile(t, lines.String())
+	var expected bytes.Buffer
+	if err := run([]string{filename}, &options{workers: 1, sort: "first-seen"}, &expected); err != nil {
+		t.Fatal(err)
+	}
+	for seed := range int64(10) {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &options{workers: 3, chunkBytes: 64, sort: "first-seen", shuffle: true, shuffleSeed: seed}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected.String() {
+			t.Errorf("Wrong first-seen order with shuffle seed %d, expected: %s, got: %s", seed, expected.String(), buf.String())
+		}
+	}
+
+	// chunks are dispatched in the shuffled order
+	defer func(f func(*table, []byte, int, *options) error) { chunkProcessor = f }(chunkProcessor)
+	var mu sync.Mutex
+	var offsets []int
+	chunkProcessor = func(measurements *table, data []byte, offset int, opts *options) error {
+		mu.Lock()
+		offsets = append(offsets, offset)
+		mu.Unlock()
+		return processChunkInto(measurements, data, offset, opts)
+	}
+	if _, err := process(data, &options{workers: 1, chunkBytes: 4 << 10, shuffle: true, shuffleSeed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if slices.IsSorted(offsets) {
+		t.Errorf("Chunks are not shuffled: %v", offsets)
+	}
+}
+
+func TestTableCollision(t *testing.T) {
+	tb := newTable(0)
+	// same key for different ids
+	const key = 42
+	tb.add(key, []byte("Hamburg"), 120)
+	tb.add(key, []byte("Bulawayo"), 89)
+	tb.add(key, []byte("Hamburg"), 100)
+
+	expected := map[string]*measurement{
+		"Hamburg":  {min: 100, max: 120, sum: 220, count: 2, sumSquares: 120*120 + 100*100},
+		"Bulawayo": {min: 89, max: 89, sum: 89, count: 1, sumSquares: 89 * 89},
+	}
+	if measurements := tb.result(); !reflect.DeepEqual(measurements, expected) {
+		t.Errorf("Measurements with colliding keys mismatch, expected: %v, got: %v", expected, measurements)
+	}
+}
+
+func TestTableDuplicateId(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunk results of colliding keys and growing tables have a single entry per station
+	defer func(m uint64) { keyMask = m }(keyMask)
+	for _, mask := range []uint64{^uint64(0), 0xff} {
+		keyMask = mask
+		tb, err := processChunk(data, 0, &options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, ok := tb.duplicateId(); ok {
+			t.Errorf("Station %q has duplicate entries with key mask %x", id, mask)
+		}
+	}
+
+	tb := newTable(0)
+	tb.add(1, []byte("Hamburg"), 120)
+	tb.add(2, []byte("Bulawayo"), 89)
+	// simulate double emission of a station
+	tb.entries[3] = tb.entries[1]
+	if id, ok := tb.duplicateId(); !ok || id != "Hamburg" {
+		t.Errorf("Expected duplicate Hamburg, got: %q, %v", id, ok)
+	}
+}
+
+func TestProcessKeyCollisions(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-20.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mustProcess(t, data, &options{workers: 3})
+
+	// all stations have the same key
+	defer func(m uint64) { keyMask = m }(keyMask)
+	keyMask = 0
+
+	measurements := mustProcess(t, data, &options{workers: 3})
+	if len(measurements) != len(expected) {
+		t.Errorf("Wrong number of stations with colliding keys, expected: %d, got: %d", len(expected), len(measurements))
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Errorf("Measurements with colliding keys mismatch, expected: %v, got: %v", expected, measurements)
+	}
+}
+
+func TestProcessDelimiter(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mustProcess(t, data, &options{})
+
+	tabData := bytes.ReplaceAll(data, []byte(";"), []byte("\t"))
+	for _, opts := range []*options{
+		{delimiter: '\t'},
+		{delimiter: '\t', workers: 8},
+		{delimiter: '\t', strict: true},
+	} {
+		if !reflect.DeepEqual(mustProcess(t, tabData, opts), expected) {
+			t.Errorf("Result of tab-delimited input differs with options %+v", opts)
+		}
+	}
+}
+
+func TestProcessCRLF(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlfData := bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+
+	for _, workers := range []int{1, 8} {
+		opts := &options{workers: workers}
+		if !reflect.DeepEqual(mustProcess(t, crlfData, opts), mustProcess(t, data, opts)) {
+			t.Errorf("Result of CRLF input differs from LF input with %d workers", workers)
+		}
+	}
+}
+
+func TestProcessTempFilter(t *testing.T) {
+	const input = "Foo;-500.0\nFoo;20.0\nFoo;600.0\nBar;-50.0\nBar;50.0\nBar;50.1\nBaz;-50.1\n"
+
+	for _, workers := range []int{1, 3} {
+		measurements := mustProcess(t, []byte(input), &options{workers: workers, tempFilter: true, minTemp: -500, maxTemp: 500})
+
+		// range is inclusive and Baz has no valid measurements
+		expected := map[string]*measurement{
+			"Foo": {min: 200, max: 200, sum: 200, count: 1, sumSquares: 200 * 200},
+			"Bar": {min: -500, max: 500, sum: 0, count: 2, sumSquares: 2 * 500 * 500},
+		}
+		if !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong filtered measurements with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
+	}
+}
+
+func TestProcessAssertFinite(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		bound    int64
+		exponent bool
+		err      string
+	}{
+		{input: "Foo;1.2\nFoo;1999999999.9\nBar;-3.0\n", bound: 10000, err: `temperature out of bounds at offset 8: "Foo;1999999999.9"`},
+		// would wrap around to 0 and -10
+		{input: "Foo;1.2\nA;1844674407370955161.6\n", bound: 10000, err: `temperature out of bounds at offset 8: "A;1844674407370955161.6"`},
+		{input: "Foo;1.2\nA;-1844674407370955162.6\n", bound: 10000, err: `temperature out of bounds at offset 8: "A;-1844674407370955162.6"`},
+		{input: "Foo;1.2\nA;99999999999999999999999.9\n", bound: 10000, err: `temperature out of bounds at offset 8: "A;99999999999999999999999.9"`},
+		{input: "Foo;1.2\nA;1e300\n", bound: 10000, exponent: true, err: `temperature out of bounds at offset 8: "A;1e300"`},
+		{input: "Foo;1.2\nBar;-1000.1\n", bound: 10000, err: `temperature out of bounds at offset 8: "Bar;-1000.1"`},
+		{input: "Foo;1000.0\nBar;-1000.0\n", bound: 10000},
+		{input: "Foo;50.0\nBar;-50.1\n", bound: 500, err: `temperature out of bounds at offset 9: "Bar;-50.1"`},
+	} {
+		for _, workers := range []int{1, 3} {
+			_, err := process([]byte(tc.input), &options{workers: workers, maxAbsTemp: tc.bound, allowExponent: tc.exponent})
+			if tc.err == "" && err != nil {
+				t.Errorf("Unexpected error for %q: %v", tc.input, err)
+			} else if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("Wrong error for %q with %d workers, expected: %s, got: %v", tc.input, workers, tc.err, err)
+			}
+		}
+	}
+
+	// without the assertion the value corrupts the mean silently
+	measurements := mustProcess(t, []byte("Foo;1.2\nFoo;1999999999.9\n"), &options{})
+	if s := measurements["Foo"].stats(); s.Max() != 1999999999.9 {
+		t.Errorf("Unexpected max: %v", s.Max())
+	}
+}
+
+func TestProcessIgnoreComments(t *testing.T) {
+	const input = "# station;temperature\nFoo;1.0\n  # indented comment\n\t#tab;2.0\nBar;2.0\r\n#\nFoo#1;3.0\n"
+
+	expected := map[string]*measurement{
+		"Foo":   {min: 10, max: 10, sum: 10, count: 1, sumSquares: 100},
+		"Bar":   {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+		"Foo#1": {min: 30, max: 30, sum: 30, count: 1, sumSquares: 900},
+	}
+	for _, opts := range []*options{{ignoreComments: true}, {ignoreComments: true, strict: true}, {ignoreComments: true, workers: 3}} {
+		if measurements := mustProcess(t, []byte(input), opts); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong aggregation with %+v, expected: %v, got: %v", *opts, expected, measurements)
+		}
+	}
+
+	var stdout bytes.Buffer
+	if err := run([]string{writeTempFile(t, input)}, &options{ignoreComments: true, verify: true}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessValueFirst(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var valueFirst bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte{'\n'}) {
+		if id, value, ok := bytes.Cut(bytes.TrimSuffix(line, []byte{'\n'}), []byte{';'}); ok {
+			fmt.Fprintf(&valueFirst, "%s;%s\n", value, id)
+		}
+	}
+
+	expected := mustProcess(t, data, &options{})
+	for _, opts := range []*options{{valueFirst: true}, {valueFirst: true, strict: true}, {valueFirst: true, workers: 3}} {
+		if measurements := mustProcess(t, valueFirst.Bytes(), opts); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Result of value first records with %+v differs from name first result", *opts)
+		}
+	}
+}
+
+func TestProcessAllowExponent(t *testing.T) {
+	const input = "Foo;1.2e1\nFoo;12.0\nBar;-5E-1\nBar;2.5e+0\nBaz;1.2ex\n"
+
+	expected := map[string]*measurement{
+		"Foo": {min: 120, max: 120, sum: 240, count: 2, sumSquares: 2 * 120 * 120},
+		"Bar": {min: -5, max: 25, sum: 20, count: 2, sumSquares: 25 + 625},
+	}
+	for _, workers := range []int{1, 3} {
+		if measurements := mustProcess(t, []byte(input), &options{workers: workers, allowExponent: true}); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong aggregation with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
+	}
+
+	if _, err := process([]byte(input), &options{allowExponent: true, strict: true}); err == nil {
+		t.Error("Expected error for malformed exponent in strict mode")
+	}
+	if measurements := mustProcess(t, []byte("Foo;1.2e1\n"), &options{allowExponent: true, strict: true}); measurements["Foo"].max != 120 {
+		t.Errorf("Wrong strict aggregation: %v", measurements["Foo"])
+	}
+}
+
+func TestProcessMissingValues(t *testing.T) {
+	// missing values in the middle and at the end of 8-byte words and input
+	const input = "Foo;NaN\nFoo;1.0\nBar;\nBar;-2.0\r\nBaz;NaN\r\nBar;2.0\nBaz;\r\nFoo;"
+
+	for _, tc := range []struct {
+		missingValues string
+		expected      map[string]*measurement
+	}{
+		{
+			missingValues: "",
+			expected: map[string]*measurement{
+				"Foo": {min: 10, max: 10, sum: 10, count: 1, sumSquares: 100},
+				"Bar": {min: -20, max: 20, sum: 0, count: 2, sumSquares: 800},
+			},
+		},
+		{
+			missingValues: "zero",
+			expected: map[string]*measurement{
+				"Foo": {min: 0, max: 10, sum: 10, count: 3, sumSquares: 100},
+				"Bar": {min: -20, max: 20, sum: 0, count: 3, sumSquares: 800},
+				"Baz": {min: 0, max: 0, sum: 0, count: 2, sumSquares: 0},
+			},
+		},
+	} {
+		for _, workers := range []int{1, 3} {
+			measurements := mustProcess(t, []byte(input), &options{workers: workers, missingValues: tc.missingValues})
+			if !reflect.DeepEqual(measurements, tc.expected) {
+				t.Errorf("Wrong aggregation of %q missing values with %d workers, expected: %v, got: %v", tc.missingValues, workers, tc.expected, measurements)
+			}
+		}
+		if err := run([]string{writeTempFile(t, input)}, &options{missingValues: tc.missingValues, verify: true}, io.Discard); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := process([]byte(input), &options{missingValues: "error"}); err == nil {
+		t.Error("Expected error for missing value")
+	}
+
+	// strict mode fails on missing values unless they are explicitly skipped
+	if _, err := process([]byte(input), &options{strict: true}); err == nil {
+		t.Error("Expected error for missing value in strict mode")
+	}
+	if !reflect.DeepEqual(mustProcess(t, []byte(input), &options{missingValues: "skip", strict: true}), mustProcess(t, []byte(input), &options{})) {
+		t.Error("Strict mode result with skipped missing values differs from the default one")
+	}
+}
+
+func TestParseDegrees(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected int64
+	}{
+		{value: "-50", expected: -500},
+		{value: "50", expected: 500},
+		{value: "12.3", expected: 123},
+		{value: "-0.1", expected: -1},
+	} {
+		if temp, err := parseDegrees(tc.value); err != nil || temp != tc.expected {
+			t.Errorf("Wrong parsing of %s, expected: %d, got: %d, %v", tc.value, tc.expected, temp, err)
+		}
+	}
+	for _, value := range []string{"", "abc", "NaN", "Inf", "1e300"} {
+		if _, err := parseDegrees(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestProcessStrict(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		err   string
 	}{
-		{value: "-99.9", expected: "-999"},
-		{value: "-12.3", expected: "-123"},
-		{value: "-1.5", expected: "-15"},
-		{value: "-1.0", expected: "-10"},
-		{value: "0.0", expected: "0"},
-		{value: "0.3", expected: "3"},
-		{value: "12.3", expected: "123"},
-		{value: "99.9", expected: "999"},
+		{input: "Foo;1.2\nFoo;ab.c\n", err: `malformed line at offset 8: "Foo;ab.c"`},
+		{input: "Foo;1.2\nFoo;12\n", err: `malformed line at offset 8: "Foo;12"`},
+		{input: "Foo;1.2\nFoo\n", err: `malformed line at offset 8: "Foo"`},
+		{input: "Foo;1.2\nFoo;-1.2.3\n", err: `malformed line at offset 8: "Foo;-1.2.3"`},
+		{input: "Foo;1.2\r\nFoo;-1.2\r\nFoo;12\r\n", err: `malformed line at offset 19: "Foo;12"`},
+		{input: "Foo;1.2\nFoo;\n", err: `malformed line at offset 8: "Foo;"`},
+		{input: "Foo;1.2\r\nFoo;NaN\r\n", err: `malformed line at offset 9: "Foo;NaN"`},
+		{input: "Foo;1.2\r\nFoo;-12.3\r\nBar;0.0"},
 	} {
-		if number := parseNumber([]byte(tc.value)); fmt.Sprintf("%d", number) != tc.expected {
-			t.Errorf("Wrong parsing of %v, expected: %s, got: %d", tc.value, tc.expected, number)
+		_, err := process([]byte(tc.input), &options{strict: true})
+		if tc.err == "" && err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.input, err)
+		} else if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("Wrong error for %q, expected: %s, got: %v", tc.input, tc.err, err)
 		}
 	}
 }
 
+func TestProcessStrictValid(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(mustProcess(t, data, &options{strict: true}), mustProcess(t, data, &options{})) {
+		t.Error("Strict mode result differs from the default one")
+	}
+}
+
+func mustProcess(tb testing.TB, data []byte, opts *options) map[string]*measurement {
+	tb.Helper()
+
+	measurements, err := process(data, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return measurements
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
 var parseNumberSink int64
 
 func BenchmarkParseNumber(b *testing.B) {
@@ -60,6 +1416,56 @@ func BenchmarkParseNumber(b *testing.B) {
 	}
 }
 
+// BenchmarkParseNumberShapes compares parsing of numbers of -?d?d.d shapes by parseNumberWord
+// of a word assembled from bytes of the value with parseNumber that parses them by length without a loop.
+func BenchmarkParseNumberShapes(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	values := make([][]byte, 1024)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("%.1f", float64(rnd.Intn(1999)-999)/10))
+	}
+
+	b.Run("length", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			parseNumberSink += parseNumber(values[i%len(values)])
+		}
+	})
+
+	b.Run("word", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var word uint64
+			for j, c := range values[i%len(values)] {
+				word |= uint64(c) << (8 * j)
+			}
+			n, _, _ := parseNumberWord(word)
+			parseNumberSink += n
+		}
+	})
+}
+
+// BenchmarkParseNumberLine compares branchless and branching parsing of mixed number formats.
+func BenchmarkParseNumberLine(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	lines := make([][]byte, 1024)
+	for i := range lines {
+		lines[i] = []byte(fmt.Sprintf("%.1f\nFoo;1.0\n", float64(rnd.Intn(1999)-999)/10))
+	}
+
+	b.Run("branches", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n, _ := parseNumberLine(lines[i%len(lines)])
+			parseNumberSink += n
+		}
+	})
+
+	b.Run("word", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n, _, _ := parseNumberWord(binary.LittleEndian.Uint64(lines[i%len(lines)]))
+			parseNumberSink += n
+		}
+	})
+}
+
 func BenchmarkProcess(b *testing.B) {
 	// $ ./create_measurements.sh 1000000 && mv measurements.txt measurements-1e6.txt
 	// Created file with 1,000,000 measurements in 514 ms
@@ -70,7 +1476,7 @@ func BenchmarkProcess(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	measurements := process(data)
+	measurements := mustProcess(b, data, &options{})
 	rows := int64(0)
 	for _, m := range measurements {
 		rows += m.count
@@ -81,6 +1487,470 @@ func BenchmarkProcess(b *testing.B) {
 	b.ReportMetric(float64(rows), "rows/op")
 
 	for i := 0; i < b.N; i++ {
-		process(data)
+		process(data, &options{})
+	}
+}
+
+// BenchmarkProcessFile compares processing of memory-mapped file with and without madvise.
+// Drop page cache between runs to measure the readahead effect:
+// $ sync && echo 3 | sudo tee /proc/sys/vm/drop_caches
+func BenchmarkProcessFile(b *testing.B) {
+	const filename = "../../../measurements-1e6.txt"
+
+	for _, tc := range []struct {
+		name string
+		opts options
+	}{
+		{"madvise", options{}},
+		{"nomadvise", options{noAdvise: true}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := processFile(filename, &tc.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkProcessChunk(b *testing.B) {
+	const filename = "../../../measurements-1e6.txt"
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("buckets", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			processChunkBuckets(data)
+		}
+	})
+
+	b.Run("table", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			processChunk(data, 0, &options{})
+		}
+	})
+}
+
+var hashSink uint64
+
+func BenchmarkHashId(b *testing.B) {
+	id := []byte("Petropavlovsk-Kamchatsky")
+
+	b.Run("fnv1a", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h := uint64(14695981039346656037)
+			for _, c := range id {
+				h ^= uint64(c)
+				h *= 1099511628211
+			}
+			hashSink = h
+		}
+	})
+
+	b.Run("hashId", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hashSink = hashId(id)
+		}
+	})
+}
+
+func BenchmarkProcessStations(b *testing.B) {
+	const nStations = 10_000
+
+	var data bytes.Buffer
+	for i := 0; i < 100*nStations; i++ {
+		fmt.Fprintf(&data, "station-%d;%d.%d\n", i%nStations, i%100, i%10)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts options
+	}{
+		{"default", options{}},
+		{"presized", options{stations: nStations}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := process(data.Bytes(), &tc.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkProcessSkewed processes data where the first region is dense with unique stations
+// and compares chunk per worker with more chunks than workers.
+func BenchmarkProcessSkewed(b *testing.B) {
+	const nLines = 1_000_000
+
+	var data bytes.Buffer
+	for i := 0; i < nLines; i++ {
+		if i < nLines/8 {
+			fmt.Fprintf(&data, "station-%d;%d.%d\n", i, i%100, i%10)
+		} else {
+			fmt.Fprintf(&data, "station-%d;%d.%d\n", i%10, i%100, i%10)
+		}
+	}
+
+	defer func(n int) { chunksPerWorker = n }(chunksPerWorker)
+
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("chunksPerWorker=%d", n), func(b *testing.B) {
+			chunksPerWorker = n
+			opts := &options{workers: 4}
+
+			b.SetBytes(int64(data.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := process(data.Bytes(), opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+var benchMeasurements = flag.String("measurements", "../../../measurements-1e6.txt", "measurements file of BenchmarkParse")
+
+// BenchmarkParse compares parse that searches for delimiter a word at a time and
+// locates line end by the number format with bytewise single pass over each line.
+// Use larger file to compare on the full dataset:
+// $ go test -run NONE -bench Parse -measurements=../../../measurements.txt
+func BenchmarkParse(b *testing.B) {
+	data, err := os.ReadFile(*benchMeasurements)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("swar", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			parse(newTable(0), data, ';')
+		}
+	})
+
+	b.Run("single-pass", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			parseSinglePass(newTable(0), data, ';')
+		}
+	})
+}
+
+// parseSinglePass is the alternative to parse that finds delimiter and newline positions
+// in a single bytewise scan of the line.
+func parseSinglePass(measurements *table, data []byte, delimiter byte) {
+	for len(data) > 0 {
+		semiPos, nlPos := -1, len(data)
+		for i, b := range data {
+			if b == delimiter {
+				semiPos = i
+			} else if b == '\n' {
+				nlPos = i
+				break
+			}
+		}
+
+		line := data[:nlPos]
+		data = data[min(nlPos+1, len(data)):]
+		if semiPos == -1 {
+			// skip empty line
+			continue
+		}
+
+		idData := line[:semiPos]
+		measurements.add(hashId(idData), idData, parseNumber(bytes.TrimSuffix(line[semiPos+1:], []byte{'\r'})))
+	}
+}
+
+func BenchmarkMergeTables(b *testing.B) {
+	const (
+		nChunks   = 64
+		nStations = 100_000
+	)
+
+	// each chunk has all stations
+	var data bytes.Buffer
+	for i := 0; i < nStations; i++ {
+		fmt.Fprintf(&data, "station-%d;%d.%d\n", i, i%100, i%10)
+	}
+
+	tables := make([]*table, nChunks)
+	newTables := func() {
+		for i := range tables {
+			t, err := processChunk(data.Bytes(), 0, &options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			tables[i] = t
+		}
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			newTables()
+			b.StartTimer()
+
+			measurements := make(map[string]*measurement)
+			for _, t := range tables {
+				mergeMeasurements(measurements, t.result())
+			}
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			newTables()
+			b.StartTimer()
+
+			mergeTables(tables, runtime.NumCPU())
+		}
+	})
+}
+
+// BenchmarkProcessMerge compares peak and retained heap of merging all worker tables
+// at the end with merging every table as its worker completes.
+// The parallel merge result refers to measurements of the tables and keeps them alive.
+func BenchmarkProcessMerge(b *testing.B) {
+	const nStations = 200_000
+
+	// every chunk has all stations or stations of its region of the file
+	var spread, regional bytes.Buffer
+	for i := 0; i < 10*nStations; i++ {
+		fmt.Fprintf(&spread, "station-%d;%d.%d\n", i%nStations, i%100, i%10)
+		fmt.Fprintf(&regional, "station-%d;%d.%d\n", i/10, i%100, i%10)
+	}
+
+	for _, bc := range []struct {
+		name        string
+		data        *bytes.Buffer
+		incremental bool
+	}{
+		{"spread", &spread, false},
+		{"spread", &spread, true},
+		{"regional", &regional, false},
+		{"regional", &regional, true},
+	} {
+		data := bc.data
+		b.Run(fmt.Sprintf("%s/incremental=%v", bc.name, bc.incremental), func(b *testing.B) {
+			opts := &options{workers: 4, incrementalMerge: bc.incremental}
+
+			var peak, retained uint64
+			var ms runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				base := ms.HeapAlloc
+
+				var heap uint64
+				stop := samplePeakHeap(&heap)
+				measurements, err := process(data.Bytes(), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				stop()
+				peak = max(peak, heap-min(base, heap))
+
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				retained = max(retained, ms.HeapAlloc-min(base, ms.HeapAlloc))
+				runtime.KeepAlive(measurements)
+			}
+			b.ReportMetric(float64(peak), "peak-heap-bytes")
+			b.ReportMetric(float64(retained), "retained-heap-bytes")
+		})
+	}
+}
+
+// samplePeakHeap periodically updates peak with the heap size until stopped.
+func samplePeakHeap(peak *uint64) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			*peak = max(*peak, ms.HeapAlloc)
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// processChunkBuckets is the processChunk implementation preceding the open addressing table
+// kept to compare performance.
+func processChunkBuckets(data []byte) map[string]*measurement {
+	// use uint64 FNV-1a hash of id value as buckets key and keep mapping to the id value.
+	// This assumes no collisions of id hashes.
+	const (
+		// use power of 2 for fast modulo calculation
+		nBuckets = 1 << 12
+		maxIds   = 10_000
+
+		fnv1aOffset64 = 14695981039346656037
+		fnv1aPrime64  = 1099511628211
+	)
+
+	type entry struct {
+		key uint64
+		mid int
+	}
+	buckets := make([][]entry, nBuckets)
+	measurements := make([]measurement, 0, maxIds)
+	ids := make(map[uint64][]byte)
+
+	getMeasurement := func(key uint64) *measurement {
+		i := key & uint64(nBuckets-1)
+		for j := 0; j < len(buckets[i]); j++ {
+			e := &buckets[i][j]
+			if e.key == key {
+				return &measurements[e.mid]
+			}
+		}
+		return nil
+	}
+
+	putMeasurement := func(key uint64, m measurement) {
+		i := key & uint64(nBuckets-1)
+		buckets[i] = append(buckets[i], entry{key: key, mid: len(measurements)})
+		measurements = append(measurements, m)
+	}
+
+	// assume valid input
+	for len(data) > 0 {
+
+		idHash := uint64(fnv1aOffset64)
+		semiPos := 0
+		for i, b := range data {
+			if b == ';' {
+				semiPos = i
+				break
+			}
+
+			// calculate FNV-1a hash
+			idHash ^= uint64(b)
+			idHash *= fnv1aPrime64
+		}
+
+		idData := data[:semiPos]
+
+		data = data[semiPos+1:]
+
+		var temp int64
+		// parseNumber
+		{
+			negative := data[0] == '-'
+			if negative {
+				data = data[1:]
+			}
+
+			_ = data[3]
+			if data[1] == '.' {
+				// 1.2\n
+				temp = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
+				data = data[4:]
+				// 12.3\n
+			} else {
+				_ = data[4]
+				temp = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
+				data = data[5:]
+			}
+
+			if negative {
+				temp = -temp
+			}
+		}
+
+		m := getMeasurement(idHash)
+		if m == nil {
+			putMeasurement(idHash, measurement{
+				min:   temp,
+				max:   temp,
+				sum:   temp,
+				count: 1,
+			})
+			ids[idHash] = idData
+		} else {
+			m.min = min(m.min, temp)
+			m.max = max(m.max, temp)
+			m.sum += temp
+			m.count++
+		}
+	}
+
+	result := make(map[string]*measurement, len(measurements))
+	for _, bucket := range buckets {
+		for _, entry := range bucket {
+			result[string(ids[entry.key])] = &measurements[entry.mid]
+		}
+	}
+	return result
+}
+
+func TestMainUsage(t *testing.T) {
+	if os.Getenv("TEST_MAIN_USAGE") == "1" {
+		os.Args = []string{"1brc"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainUsage$")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_USAGE=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, got: %v", err)
+	}
+	for _, s := range []string{"Missing measurements filename", "Usage: 1brc [flags] file...", "-workers"} {
+		if !strings.Contains(stderr.String(), s) {
+			t.Errorf("Expected %q in usage: %s", s, stderr.String())
+		}
+	}
+}
+
+func TestProcessChunkPanic(t *testing.T) {
+	defer func(f func(*table, []byte, int, *options) error) { chunkProcessor = f }(chunkProcessor)
+	chunkProcessor = func(measurements *table, data []byte, offset int, opts *options) error {
+		if bytes.HasPrefix(data, []byte("Bar;")) {
+			var fault []byte
+			_ = fault[offset]
+		}
+		return processChunkInto(measurements, data, offset, opts)
+	}
+
+	data := []byte("Foo;1.0\nFoo;2.0\nBar;3.0\nBar;4.0\nBaz;5.0\nBaz;6.0\n")
+	for _, workers := range []int{1, 3} {
+		measurements, err := process(data, &options{workers: workers, chunkBytes: 16})
+		if err == nil || !strings.Contains(err.Error(), "chunk at offset 16: panic: runtime error: index out of range") {
+			t.Errorf("Wrong error with %d workers: %v", workers, err)
+		}
+		expected := map[string]*measurement{
+			"Foo": {min: 10, max: 20, sum: 30, count: 2, sumSquares: 100 + 400},
+			"Baz": {min: 50, max: 60, sum: 110, count: 2, sumSquares: 2500 + 3600},
+		}
+		if !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong partial aggregation with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
 	}
 }
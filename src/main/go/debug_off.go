@@ -0,0 +1,6 @@
+//go:build !debug
+
+package main
+
+// debug enables internal consistency checks, build with -tags debug.
+const debug = false
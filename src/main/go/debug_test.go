@@ -0,0 +1,18 @@
+//go:build debug
+
+package main
+
+import "testing"
+
+func TestMergeTablesDuplicateId(t *testing.T) {
+	tb := newTable(0)
+	tb.add(1, []byte("Hamburg"), 120)
+	tb.entries[3] = tb.entries[1]
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected panic for duplicate station entries")
+		}
+	}()
+	mergeTables([]*table{newTable(0), tb}, 2)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// maxReportedLines limits the number of malformed lines reported by dry run.
+const maxReportedLines = 5
+
+// dryRun validates input lines instead of aggregating them.
+// It counts malformed lines and keeps the first ones for the report.
+type dryRun struct {
+	malformed atomic.Int64
+
+	mu    sync.Mutex
+	lines []malformedLine // ordered by offset
+}
+
+type malformedLine struct {
+	offset int
+	line   string
+}
+
+// check validates that lines of data have a single delimiter and a number in the reference format.
+func (d *dryRun) check(data []byte, offset int, delimiter byte, opts *options) {
+	for len(data) > 0 {
+		line := data
+		if nlPos := bytes.IndexByte(data, '\n'); nlPos != -1 {
+			line, data = data[:nlPos], data[nlPos+1:]
+		} else {
+			data = nil
+		}
+		lineOffset := offset
+		offset += len(line) + 1
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 || opts.ignoreComments && isComment(line) {
+			continue
+		}
+
+		id, value, ok := bytes.Cut(line, []byte{delimiter})
+		if !ok || len(id) == 0 || bytes.IndexByte(value, delimiter) != -1 || !isValidNumber(value) {
+			d.add(lineOffset, line)
+		}
+	}
+}
+
+func (d *dryRun) add(offset int, line []byte) {
+	d.malformed.Add(1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// chunks are checked concurrently so keep the lines with the lowest offsets
+	if len(d.lines) == maxReportedLines && offset > d.lines[len(d.lines)-1].offset {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(d.lines, offset, func(l malformedLine, offset int) int { return l.offset - offset })
+	d.lines = slices.Insert(d.lines, i, malformedLine{offset, string(line)})
+	if len(d.lines) > maxReportedLines {
+		d.lines = d.lines[:maxReportedLines]
+	}
+}
+
+// report writes the number of malformed lines followed by the first of them.
+// It returns error if any line is malformed so that dry run fails validation.
+func (d *dryRun) report(w io.Writer) error {
+	malformed := d.malformed.Load()
+	if _, err := fmt.Fprintf(w, "found %d malformed lines\n", malformed); err != nil {
+		return err
+	}
+	for _, l := range d.lines {
+		if _, err := fmt.Fprintf(w, "malformed line at offset %d: %q\n", l.offset, l.line); err != nil {
+			return err
+		}
+	}
+	if malformed > 0 {
+		return fmt.Errorf("dry run found %d malformed lines", malformed)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRunDryRun(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar\nFoo;2.0\nBaz;1.0;2.0\n\nQux;12.34\nBar;-3.0\n")
+
+	for _, workers := range []int{1, 3} {
+		var stdout, stderr bytes.Buffer
+		err := run([]string{filename}, &options{workers: workers, dryRun: new(dryRun), stderr: &stderr}, &stdout)
+		if expected := "dry run found 3 malformed lines"; err == nil || err.Error() != expected {
+			t.Errorf("Wrong error with %d workers, expected: %s, got: %v", workers, expected, err)
+		}
+		expected := "found 3 malformed lines\n" +
+			"malformed line at offset 8: \"Bar\"\n" +
+			"malformed line at offset 20: \"Baz;1.0;2.0\"\n" +
+			"malformed line at offset 33: \"Qux;12.34\"\n"
+		if stderr.String() != expected {
+			t.Errorf("Wrong report with %d workers, expected: %q, got: %q", workers, expected, stderr.String())
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("Unexpected output: %q", stdout.String())
+		}
+	}
+
+	// quiet mode does not discard the report
+	for _, quiet := range []bool{false, true} {
+		var stderr bytes.Buffer
+		if err := run([]string{writeTempFile(t, "Foo;1.0\nBar;-3.0\n")}, &options{dryRun: new(dryRun), quiet: quiet, stderr: &stderr}, io.Discard); err != nil {
+			t.Errorf("Unexpected error for valid file: %v", err)
+		}
+		if expected := "found 0 malformed lines\n"; stderr.String() != expected {
+			t.Errorf("Wrong report with quiet %v, expected: %q, got: %q", quiet, expected, stderr.String())
+		}
+	}
+}
+
+func TestDryRunReportsFirstLines(t *testing.T) {
+	var sb strings.Builder
+	for i := range 100 {
+		fmt.Fprintf(&sb, "Foo%d;x\n", i)
+	}
+	data := []byte(sb.String())
+
+	d := new(dryRun)
+	// check the second half first like a concurrent worker could
+	half := bytes.IndexByte(data[len(data)/2:], '\n') + len(data)/2 + 1
+	d.check(data[half:], half, ';', &options{})
+	d.check(data[:half], 0, ';', &options{})
+
+	var buf bytes.Buffer
+	if err := d.report(&buf); err == nil {
+		t.Error("Expected error for malformed lines")
+	}
+	expected := "found 100 malformed lines\n" +
+		"malformed line at offset 0: \"Foo0;x\"\n" +
+		"malformed line at offset 7: \"Foo1;x\"\n" +
+		"malformed line at offset 14: \"Foo2;x\"\n" +
+		"malformed line at offset 21: \"Foo3;x\"\n" +
+		"malformed line at offset 28: \"Foo4;x\"\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong report, expected: %q, got: %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// lineEndings counts line endings of processed input to detect files that mix LF and CRLF lines.
+// CR before LF is stripped by all parsers so mixed files aggregate correctly,
+// while bare CR not followed by LF becomes a part of station names or values.
+type lineEndings struct {
+	lf, crlf, bareCR atomic.Int64
+}
+
+// count adds line endings of data.
+func (e *lineEndings) count(data []byte) {
+	lines := int64(bytes.Count(data, []byte{'\n'}))
+	crlf := int64(bytes.Count(data, []byte{'\r', '\n'}))
+	cr := int64(bytes.Count(data, []byte{'\r'}))
+	e.lf.Add(lines - crlf)
+	e.crlf.Add(crlf)
+	e.bareCR.Add(cr - crlf)
+}
+
+// report writes the number of line endings of every kind and warns about mixed ones.
+func (e *lineEndings) report(w io.Writer) error {
+	lf, crlf, bareCR := e.lf.Load(), e.crlf.Load(), e.bareCR.Load()
+	if _, err := fmt.Fprintf(w, "line endings: %d LF, %d CRLF, %d bare CR\n", lf, crlf, bareCR); err != nil {
+		return err
+	}
+	if lf > 0 && crlf > 0 {
+		if _, err := fmt.Fprintln(w, "warning: mixed LF and CRLF line endings, CR before LF is stripped"); err != nil {
+			return err
+		}
+	}
+	if bareCR > 0 {
+		if _, err := fmt.Fprintln(w, "warning: bare CR is not a line ending, use -strict to find malformed lines"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
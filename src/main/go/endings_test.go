@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunCheckEndings(t *testing.T) {
+	const filename = "testdata/mixed-line-endings.txt"
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected bytes.Buffer
+	if err := run([]string{writeTempFile(t, strings.ReplaceAll(string(data), "\r\n", "\n"))}, &options{}, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []options{{workers: 1}, {workers: 3}, {workers: 3, strict: true}} {
+		var stdout, stderr bytes.Buffer
+		opts.endings, opts.stderr = new(lineEndings), &stderr
+		if err := run([]string{filename}, &opts, &stdout); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != expected.String() {
+			t.Errorf("Wrong output with %d workers, expected: %q, got: %q", opts.workers, expected.String(), stdout.String())
+		}
+		const report = "line endings: 3 LF, 3 CRLF, 0 bare CR\n" +
+			"warning: mixed LF and CRLF line endings, CR before LF is stripped\n"
+		if stderr.String() != report {
+			t.Errorf("Wrong report with %d workers, expected: %q, got: %q", opts.workers, report, stderr.String())
+		}
+	}
+}
+
+func TestLineEndingsBareCR(t *testing.T) {
+	var e lineEndings
+	e.count([]byte("Foo;1.0\rBar;2.0\r\nBaz;3.0\r\n"))
+
+	var buf bytes.Buffer
+	if err := e.report(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const expected = "line endings: 0 LF, 2 CRLF, 1 bare CR\n" +
+		"warning: bare CR is not a line ending, use -strict to find malformed lines\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong report, expected: %q, got: %q", expected, buf.String())
+	}
+}
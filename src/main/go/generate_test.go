@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// generatorStations is a subset of stations and their mean temperatures used by create_measurements.sh
+var generatorStations = []struct {
+	name string
+	mean float64
+}{
+	{"Abha", 18.0}, {"Abéché", 29.4}, {"Alexandria", 20.0}, {"Antsiranana", 25.2}, {"Baghdad", 22.77},
+	{"Batumi", 14.0}, {"Bishkek", 11.3}, {"Brazzaville", 25.0}, {"Cabo San Lucas", 23.9}, {"Chihuahua", 18.6},
+	{"Cotonou", 27.2}, {"Denpasar", 23.7}, {"Dubai", 26.9}, {"Erzurum", 5.1}, {"Gangtok", 15.2},
+	{"Hamburg", 9.7}, {"Heraklion", 18.9}, {"Iqaluit", -9.3}, {"Juba", 27.8}, {"Khartoum", 29.9},
+	{"Kyoto", 15.8}, {"Lhasa", 7.6}, {"Luanda", 25.8}, {"Malabo", 26.3}, {"Maun", 22.4},
+	{"Minneapolis", 7.8}, {"Murmansk", 0.6}, {"Nassau", 24.6}, {"Nouakchott", 25.7},
+	{"Ouagadougou", 28.3}, {"Paris", 12.3}, {"Port Moresby", 26.9}, {"Rabat", 17.2},
+	{"Saint Petersburg", 5.8}, {"Sana'a", 20.0}, {"Singapore", 27.0}, {"Suva", 25.6},
+	{"Tashkent", 14.8}, {"Tirana", 15.2}, {"Ulaanbaatar", -0.4}, {"Villahermosa", 27.1},
+	{"Willemstad", 28.0}, {"Zagreb", 10.7},
+}
+
+// generateMeasurements writes n measurement lines deterministically derived from seed.
+// Like create_measurements.sh it draws temperatures from normal distribution around
+// the station mean with standard deviation of 10 limited to [-99.9, 99.9].
+func generateMeasurements(w io.Writer, n int, seed int64) error {
+	r := rand.New(rand.NewSource(seed))
+	bw := bufio.NewWriter(w)
+	for i := 0; i < n; i++ {
+		s := generatorStations[r.Intn(len(generatorStations))]
+		temp := max(min(r.NormFloat64()*10+s.mean, 99.9), -99.9)
+		if _, err := fmt.Fprintf(bw, "%s;%.1f\n", s.name, temp); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeMeasurements returns name of temporary file with n generated measurement lines.
+func writeMeasurements(tb testing.TB, n int, seed int64) string {
+	tb.Helper()
+
+	filename := filepath.Join(tb.TempDir(), fmt.Sprintf("measurements-%d.txt", n))
+	f, err := os.Create(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := generateMeasurements(f, n, seed); err != nil {
+		tb.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return filename
+}
+
+func TestGenerateMeasurements(t *testing.T) {
+	const n = 10_000
+
+	filename := writeMeasurements(t, n, 1)
+	measurements, err := aggregate([]string{filename}, &options{strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := int64(0)
+	for _, s := range measurements {
+		rows += s.Count()
+	}
+	if rows != n {
+		t.Errorf("Wrong number of rows, expected: %d, got: %d", n, rows)
+	}
+
+	// same seed generates the same data
+	expected, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(writeMeasurements(t, n, 1)); err != nil {
+		t.Fatal(err)
+	} else if string(data) != string(expected) {
+		t.Error("Generated data differs for the same seed")
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	for _, n := range []int{100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("rows=%d", n), func(b *testing.B) {
+			filename := writeMeasurements(b, n, 1)
+			fi, err := os.Stat(filename)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(fi.Size())
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := Aggregate(filename); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAggregateFiles compares processing of many small files by a shared pool of workers
+// with processing them one by one and with a single file of the same total size.
+func BenchmarkAggregateFiles(b *testing.B) {
+	const nFiles = 100
+
+	filename := writeMeasurements(b, 1_000_000, 1)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir := b.TempDir()
+	var filenames []string
+	for i, part := range splitLines(data, nFiles) {
+		name := filepath.Join(dir, fmt.Sprintf("part-%03d.txt", i))
+		if err := os.WriteFile(name, part, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		filenames = append(filenames, name)
+	}
+
+	b.Run("single", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := processFiles([]string{filename}, &options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := processFiles(filenames, &options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("sequential", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			measurements := make(map[string]*measurement)
+			for _, name := range filenames {
+				fm, err := processFile(name, &options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				mergeMeasurements(measurements, fm)
+			}
+		}
+	})
+}
@@ -1,3 +1,8 @@
 module github.com/AlexanderYastrebov/1brc
 
-go 1.21.4
+go 1.23
+
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/text v0.22.0
+)
@@ -0,0 +1,59 @@
+package main
+
+// histogram counts measurements per value in tenths of degree.
+// It only covers the range of observed values to save memory,
+// values outside of [-histogramLimit, histogramLimit] are clamped.
+type histogram struct {
+	// min is the value of the first counter
+	min    int64
+	counts []int64
+}
+
+const histogramLimit = 9999
+
+func (h *histogram) add(value, n int64) {
+	value = max(min(value, histogramLimit), -histogramLimit)
+	if len(h.counts) == 0 {
+		h.min = value
+		h.counts = append(h.counts, n)
+		return
+	}
+
+	if value < h.min {
+		counts := make([]int64, h.min-value+int64(len(h.counts)))
+		copy(counts[h.min-value:], h.counts)
+		h.min, h.counts = value, counts
+	} else if i := value - h.min; i >= int64(len(h.counts)) {
+		h.counts = append(h.counts, make([]int64, i-int64(len(h.counts))+1)...)
+	}
+	h.counts[value-h.min] += n
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, n := range o.counts {
+		if n != 0 {
+			h.add(o.min+int64(i), n)
+		}
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile value, i.e.
+// the smallest value that is greater than or equal to p percent of values.
+func (h *histogram) percentile(p int64) int64 {
+	total := int64(0)
+	for _, n := range h.counts {
+		total += n
+	}
+
+	// ceil(p * total / 100)
+	rank := max((p*total+99)/100, 1)
+
+	cumulative := int64(0)
+	for i, n := range h.counts {
+		cumulative += n
+		if cumulative >= rank {
+			return h.min + int64(i)
+		}
+	}
+	return h.min + int64(len(h.counts)) - 1
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	var h histogram
+	// add values in mixed order to grow histogram in both directions
+	for i := int64(50); i >= 1; i-- {
+		h.add(i, 1)
+		h.add(101-i, 1)
+	}
+
+	for _, tc := range []struct {
+		p        int64
+		expected int64
+	}{
+		{p: 0, expected: 1},
+		{p: 1, expected: 1},
+		{p: 50, expected: 50},
+		{p: 95, expected: 95},
+		{p: 99, expected: 99},
+		{p: 100, expected: 100},
+	} {
+		if v := h.percentile(tc.p); v != tc.expected {
+			t.Errorf("Wrong p%d, expected: %d, got: %d", tc.p, tc.expected, v)
+		}
+	}
+}
+
+func TestHistogramClamp(t *testing.T) {
+	var h histogram
+	h.add(-100_000, 1)
+	h.add(100_000, 1)
+
+	if v := h.percentile(1); v != -histogramLimit {
+		t.Errorf("Wrong minimum, expected: %d, got: %d", -histogramLimit, v)
+	}
+	if v := h.percentile(100); v != histogramLimit {
+		t.Errorf("Wrong maximum, expected: %d, got: %d", histogramLimit, v)
+	}
+}
+
+func TestProcessPercentiles(t *testing.T) {
+	// Foo has values 0.1, 0.2, ..., 10.0 in shuffled order
+	var data bytes.Buffer
+	for i := 0; i < 100; i++ {
+		v := (i*37)%100 + 1
+		fmt.Fprintf(&data, "Foo;%d.%d\nBar;-1.5\n", v/10, v%10)
+	}
+
+	for _, workers := range []int{1, 7} {
+		measurements, err := process(data.Bytes(), &options{workers: workers, percentiles: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s := measurements["Foo"].stats(); s.P50 != 5.0 || s.P95 != 9.5 || s.P99 != 9.9 {
+			t.Errorf("Wrong Foo percentiles with %d workers, expected: 5.0/9.5/9.9, got: %v/%v/%v", workers, s.P50, s.P95, s.P99)
+		}
+		if s := measurements["Bar"].stats(); s.P50 != -1.5 || s.P95 != -1.5 || s.P99 != -1.5 {
+			t.Errorf("Wrong Bar percentiles with %d workers, expected: -1.5/-1.5/-1.5, got: %v/%v/%v", workers, s.P50, s.P95, s.P99)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// lineLimit limits the total number of lines processed by concurrent workers.
+// Workers claim lines a block at a time to avoid contention on the counter.
+type lineLimit struct {
+	remaining atomic.Int64
+}
+
+func newLineLimit(n int64) *lineLimit {
+	l := new(lineLimit)
+	l.remaining.Store(n)
+	return l
+}
+
+// take claims lines of the block and returns its prefix of the claimed lines,
+// empty if the limit is exhausted.
+func (l *lineLimit) take(block []byte) []byte {
+	n := int64(bytes.Count(block, []byte{'\n'}))
+	if len(block) > 0 && block[len(block)-1] != '\n' {
+		n++
+	}
+
+	claimed := n
+	if remaining := l.remaining.Add(-n); remaining < 0 {
+		claimed = max(n+remaining, 0)
+	}
+	if claimed == n {
+		return block
+	}
+
+	end := 0
+	for i := int64(0); i < claimed; i++ {
+		end += bytes.IndexByte(block[end:], '\n') + 1
+	}
+	return block[:end]
+}
+
+// exhausted reports whether no more lines can be claimed.
+func (l *lineLimit) exhausted() bool {
+	return l.remaining.Load() <= 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAggregateLimit(t *testing.T) {
+	filename := writeMeasurements(t, 1000, 1)
+
+	for _, workers := range []int{1, 4} {
+		measurements, err := aggregate([]string{filename}, &options{workers: workers, limit: newLineLimit(100)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := int64(0)
+		for _, s := range measurements {
+			n += s.Count()
+		}
+		if n != 100 {
+			t.Errorf("Wrong number of lines with %d workers, expected: 100, got: %d", workers, n)
+		}
+	}
+}
+
+func TestProcessReaderLimit(t *testing.T) {
+	f, err := os.Open(writeMeasurements(t, 1000, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	measurements, err := processReader(f, 128, &options{limit: newLineLimit(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(0)
+	for _, m := range measurements {
+		n += m.count
+	}
+	if n != 100 {
+		t.Errorf("Wrong number of lines, expected: 100, got: %d", n)
+	}
+}
+
+func TestLineLimitTake(t *testing.T) {
+	l := newLineLimit(3)
+	for _, tc := range []struct {
+		block, expected string
+	}{
+		{"Foo;1.0\nBar;2.0\n", "Foo;1.0\nBar;2.0\n"},
+		{"Baz;3.0\nQux;4.0\n", "Baz;3.0\n"},
+		{"Foo;5.0", ""},
+	} {
+		if got := l.take([]byte(tc.block)); string(got) != tc.expected {
+			t.Errorf("Wrong block of %q, expected: %q, got: %q", tc.block, tc.expected, got)
+		}
+	}
+	if !l.exhausted() {
+		t.Error("Expected exhausted limit")
+	}
+}
+
+func TestRunLimitVerify(t *testing.T) {
+	if err := run([]string{"../../test/resources/samples/measurements-1.txt"}, &options{verify: true, limit: newLineLimit(1)}, nil); err == nil {
+		t.Error("Expected error for verification with limit")
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// adviseSequential advises the kernel that mapped data will be read sequentially soon
+// to improve readahead.
+func adviseSequential(data []byte) error {
+	if err := syscall.Madvise(data, syscall.MADV_SEQUENTIAL); err != nil {
+		return err
+	}
+	return syscall.Madvise(data, syscall.MADV_WILLNEED)
+}
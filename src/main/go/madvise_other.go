@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func adviseSequential(data []byte) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// mmapRetries is the number of retries of mmap failing with a transient error,
+// e.g. on network filesystems, the delay between retries doubles starting from mmapRetryDelay.
+const (
+	mmapRetries    = 3
+	mmapRetryDelay = 10 * time.Millisecond
+)
+
+// mmap is a variable to simulate transient mmap failures in tests.
+var mmap = syscall.Mmap
+
+func mmapFile(f *os.File, size int) ([]byte, func() error, error) {
+	data, err := mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	for i, delay := 0, mmapRetryDelay; i < mmapRetries && isTransient(err); i, delay = i+1, 2*delay {
+		time.Sleep(delay)
+		data, err = mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	}
+	if err != nil {
+		return nil, nil, os.NewSyscallError("mmap", err)
+	}
+	return data, func() error { return os.NewSyscallError("munmap", syscall.Munmap(data)) }, nil
+}
+
+// isTransient reports whether mmap error may go away on retry.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY)
+}
@@ -0,0 +1,102 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestProcessTruncatedFile(t *testing.T) {
+	f, err := os.Open(writeMeasurements(t, 10_000, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, unmap, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmap()
+
+	// access to mapped pages beyond the end of file faults
+	if err := os.Truncate(f.Name(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(data, &options{workers: 4}); err == nil {
+		t.Error("Expected error for truncated file")
+	}
+}
+
+func TestMmapFileRetry(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(m func(int, int64, int, int, int) ([]byte, error)) { mmap = m }(mmap)
+	failing := func(failures int, failure error) *int {
+		calls := 0
+		mmap = func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+			if calls++; calls <= failures {
+				return nil, failure
+			}
+			return syscall.Mmap(fd, offset, length, prot, flags)
+		}
+		return &calls
+	}
+
+	calls := failing(2, syscall.EAGAIN)
+	data, unmap, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Error("Wrong mapped data")
+	}
+	if err := unmap(); err != nil {
+		t.Error(err)
+	}
+	if *calls != 3 {
+		t.Errorf("Wrong number of mmap calls, expected: 3, got: %d", *calls)
+	}
+
+	calls = failing(mmapRetries+1, syscall.EBUSY)
+	if _, _, err := mmapFile(f, int(fi.Size())); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Expected EBUSY after %d retries, got: %v", mmapRetries, err)
+	}
+	if *calls != mmapRetries+1 {
+		t.Errorf("Wrong number of mmap calls, expected: %d, got: %d", mmapRetries+1, *calls)
+	}
+
+	// other errors are not retried and processing falls back to reading the file
+	calls = failing(1, syscall.ENODEV)
+	if _, _, err := mmapFile(f, int(fi.Size())); !errors.Is(err, syscall.ENODEV) {
+		t.Errorf("Expected ENODEV, got: %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Wrong number of mmap calls, expected: 1, got: %d", *calls)
+	}
+	failing(1, syscall.ENODEV)
+	if measurements, err := Aggregate(filename); err != nil || len(measurements) != 10000 {
+		t.Errorf("Wrong fallback aggregation: %d stations, %v", len(measurements), err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// normalizer normalizes station names so that their variants aggregate together.
+type normalizer struct {
+	// trim enables trimming of surrounding whitespace
+	trim bool
+	// fold enables lowercasing of names
+	fold bool
+	// unescape enables removal of backslashes escaping the following byte
+	unescape bool
+	// groupSep enables cutting names to the leading groupLevel segments separated by it
+	groupSep   []byte
+	groupLevel int
+
+	// names keeps transformed names referenced by the table
+	names     map[string][]byte
+	buf       []byte
+	unescaped []byte
+}
+
+func (opts *options) normalizer() *normalizer {
+	if opts.normalize == "" && !opts.escape && opts.groupSep == "" {
+		return nil
+	}
+	n := &normalizer{
+		trim:     opts.normalize != "",
+		fold:     opts.normalize == "fold",
+		unescape: opts.escape,
+		names:    make(map[string][]byte),
+	}
+	if opts.groupSep != "" {
+		n.groupSep, n.groupLevel = []byte(opts.groupSep), opts.groupLevels()
+	}
+	return n
+}
+
+// groupLevels returns the number of station name segments to aggregate by.
+func (opts *options) groupLevels() int {
+	if opts.groupLevel <= 0 {
+		return 1
+	}
+	return opts.groupLevel
+}
+
+// normalize returns normalized id that remains valid until the end of processing.
+func (n *normalizer) normalize(id []byte) []byte {
+	if n.trim {
+		id = bytes.TrimSpace(id)
+	}
+
+	// transformed names are kept in buffers reused for the next id
+	transformed := false
+	if n.unescape && bytes.IndexByte(id, '\\') != -1 {
+		n.unescaped = appendUnescaped(n.unescaped[:0], id)
+		id, transformed = n.unescaped, true
+	}
+	if n.fold {
+		n.buf = appendLower(n.buf[:0], id)
+		id, transformed = n.buf, true
+	}
+	if n.groupSep != nil {
+		id = groupPrefix(id, n.groupSep, n.groupLevel)
+	}
+	if !transformed {
+		return id
+	}
+
+	if interned, ok := n.names[string(id)]; ok {
+		return interned
+	}
+	interned := bytes.Clone(id)
+	n.names[string(interned)] = interned
+	return interned
+}
+
+// groupPrefix returns the leading level segments of id separated by sep
+// or the whole id if it has fewer segments.
+func groupPrefix(id, sep []byte, level int) []byte {
+	rest := id
+	for ; level > 0; level-- {
+		i := bytes.Index(rest, sep)
+		if i == -1 {
+			return id
+		}
+		rest = rest[i+len(sep):]
+	}
+	return id[:len(id)-len(rest)-len(sep)]
+}
+
+// appendLower appends lowercased s to dst.
+func appendLower(dst, s []byte) []byte {
+	start := len(dst)
+	for _, b := range s {
+		if b >= utf8.RuneSelf {
+			return append(dst[:start], bytes.ToLower(s)...)
+		}
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+// cutEscaped slices line around the first delimiter not escaped by a backslash.
+func cutEscaped(line []byte, delimiter byte) (before, after []byte, found bool) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case delimiter:
+			return line[:i], line[i+1:], true
+		}
+	}
+	return line, nil, false
+}
+
+// appendUnescaped appends s to dst removing backslashes that escape the following byte.
+func appendUnescaped(dst, s []byte) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		dst = append(dst, s[i])
+	}
+	return dst
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestProcessNormalize(t *testing.T) {
+	const input = "Berlin;1.0\n berlin ;2.0\nBERLIN;3.0\n\tBerlin;4.0\r\nÄrhus;5.0\nÄRHUS ;6.0\n"
+
+	for _, tc := range []struct {
+		normalize string
+		expected  map[string]*measurement
+	}{
+		{
+			normalize: "fold",
+			expected: map[string]*measurement{
+				"berlin": {min: 10, max: 40, sum: 100, count: 4, sumSquares: 100 + 400 + 900 + 1600},
+				"ärhus":  {min: 50, max: 60, sum: 110, count: 2, sumSquares: 2500 + 3600},
+			},
+		},
+		{
+			normalize: "trim",
+			expected: map[string]*measurement{
+				"Berlin": {min: 10, max: 40, sum: 50, count: 2, sumSquares: 100 + 1600},
+				"berlin": {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+				"BERLIN": {min: 30, max: 30, sum: 30, count: 1, sumSquares: 900},
+				"Ärhus":  {min: 50, max: 50, sum: 50, count: 1, sumSquares: 2500},
+				"ÄRHUS":  {min: 60, max: 60, sum: 60, count: 1, sumSquares: 3600},
+			},
+		},
+	} {
+		for _, workers := range []int{1, 3} {
+			measurements := mustProcess(t, []byte(input), &options{workers: workers, normalize: tc.normalize})
+			if !reflect.DeepEqual(measurements, tc.expected) {
+				t.Errorf("Wrong %s normalization with %d workers, expected: %v, got: %v", tc.normalize, workers, tc.expected, measurements)
+			}
+		}
+	}
+}
+
+func TestProcessNormalizeStrict(t *testing.T) {
+	if _, err := process([]byte(" Foo ;1.0\nfoo;x\n"), &options{strict: true, normalize: "fold"}); err == nil {
+		t.Error("Expected error for malformed line")
+	}
+
+	measurements := mustProcess(t, []byte(" Foo ;1.0\nfoo;2.0\n"), &options{strict: true, normalize: "fold"})
+	if m := measurements["foo"]; len(measurements) != 1 || m == nil || m.count != 2 {
+		t.Errorf("Wrong strict normalization: %v", measurements)
+	}
+}
+
+func TestProcessEscape(t *testing.T) {
+	const input = "North\\;South;1.0\nNorth;2.0\nNorth\\;South;3.0\nBack\\\\slash;4.0\n"
+
+	expected := map[string]*measurement{
+		"North;South": {min: 10, max: 30, sum: 40, count: 2, sumSquares: 100 + 900},
+		"North":       {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+		`Back\slash`:  {min: 40, max: 40, sum: 40, count: 1, sumSquares: 1600},
+	}
+	for _, workers := range []int{1, 3} {
+		measurements := mustProcess(t, []byte(input), &options{workers: workers, escape: true})
+		if !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong unescaping with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
+	}
+
+	var stdout bytes.Buffer
+	if err := run([]string{writeTempFile(t, input)}, &options{escape: true, verify: true}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Back\\slash=4.0/4.0/4.0, North=2.0/2.0/2.0, North;South=1.0/2.0/3.0}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+}
+
+func TestProcessGroup(t *testing.T) {
+	const input = "EU/Berlin;1.0\nEU/Paris;2.0\nUS/Boston;3.0\nEU/DE/Munich;4.0\nMoon;5.0\n"
+
+	for _, tc := range []struct {
+		level    int
+		expected map[string]*measurement
+	}{
+		{
+			level: 1,
+			expected: map[string]*measurement{
+				"EU":   {min: 10, max: 40, sum: 70, count: 3, sumSquares: 100 + 400 + 1600},
+				"US":   {min: 30, max: 30, sum: 30, count: 1, sumSquares: 900},
+				"Moon": {min: 50, max: 50, sum: 50, count: 1, sumSquares: 2500},
+			},
+		},
+		{
+			level: 2,
+			expected: map[string]*measurement{
+				"EU/Berlin": {min: 10, max: 10, sum: 10, count: 1, sumSquares: 100},
+				"EU/Paris":  {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+				"US/Boston": {min: 30, max: 30, sum: 30, count: 1, sumSquares: 900},
+				"EU/DE":     {min: 40, max: 40, sum: 40, count: 1, sumSquares: 1600},
+				"Moon":      {min: 50, max: 50, sum: 50, count: 1, sumSquares: 2500},
+			},
+		},
+	} {
+		for _, workers := range []int{1, 3} {
+			measurements := mustProcess(t, []byte(input), &options{workers: workers, groupSep: "/", groupLevel: tc.level})
+			if !reflect.DeepEqual(measurements, tc.expected) {
+				t.Errorf("Wrong grouping by %d levels with %d workers, expected: %v, got: %v", tc.level, workers, tc.expected, measurements)
+			}
+		}
+	}
+
+	var stdout bytes.Buffer
+	if err := run([]string{writeTempFile(t, input)}, &options{groupSep: "/", verify: true}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{EU=1.0/2.3/4.0, Moon=5.0/5.0/5.0, US=3.0/3.0/3.0}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+type formatter func(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error
+
+var formatters = map[string]formatter{
+	"default":       writeDefault,
+	"compact":       writeCompact,
+	"json":          writeJSON,
+	"json-envelope": writeJSONEnvelope,
+	"csv":           writeCSV,
+	"table":         writeTable,
+	"ndjson":        writeNDJSON,
+}
+
+// streamingFormats write output incrementally instead of formatting the whole result first.
+var streamingFormats = map[string]bool{
+	"ndjson": true,
+}
+
+func (opts *options) formatter() (formatter, error) {
+	if opts.format == "" {
+		return writeDefault, nil
+	}
+	if f, ok := formatters[opts.format]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", opts.format)
+}
+
+// sortOrders compare station statistics for output ordering other than by name.
+// They put extreme values first, i.e. the coldest by min and the hottest by mean and max.
+var sortOrders = map[string]func(a, b Stats) int{
+	"min":  func(a, b Stats) int { return cmp.Compare(a.Min(), b.Min()) },
+	"mean": func(a, b Stats) int { return cmp.Compare(b.mean(), a.mean()) },
+	"max":  func(a, b Stats) int { return cmp.Compare(b.Max(), a.Max()) },
+	// first-seen keeps input order of stations
+	"first-seen": func(a, b Stats) int { return cmp.Compare(a.firstSeen, b.firstSeen) },
+}
+
+// order returns comparison function of the output order or nil for the default order by name.
+func (opts *options) order() (func(a, b Stats) int, error) {
+	if opts.sort == "" || opts.sort == "name" {
+		return nil, nil
+	}
+	if f, ok := sortOrders[opts.sort]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown sort order: %s", opts.sort)
+}
+
+// roundings round the scaled mean, min and max to an integer, see roundTo.
+// Min and max are multiples of 0.1 and are not affected unless converted from Fahrenheit.
+var roundings = map[string]func(float64) float64{
+	"half-up":   roundJava,
+	"half-even": math.RoundToEven,
+	"truncate":  truncate,
+}
+
+// roundValue rounds the value to the output precision, half-up by default.
+func (opts *options) roundValue(x float64) float64 {
+	f, ok := roundings[opts.rounding]
+	if !ok {
+		return roundTo(x, opts.decimals())
+	}
+	scale := math.Pow10(opts.decimals())
+	if r := f(x*scale) / scale; r != 0 {
+		return r
+	}
+	return 0 // avoid -0.0
+}
+
+// truncate rounds x toward zero treating x within the floating point error
+// of an integer as that integer, e.g. 0.57*100 = 56.99999999999999.
+func truncate(x float64) float64 {
+	if r := math.Round(x); math.Abs(x-r) < 1e-9 {
+		return r
+	}
+	return math.Trunc(x)
+}
+
+// checkFilters returns error if -include or -exclude pattern is malformed.
+func (opts *options) checkFilters() error {
+	for _, pattern := range []string{opts.include, opts.exclude} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid station pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// filter returns ids matching the include pattern and not matching the exclude pattern
+// preserving their order, patterns are validated by checkFilters.
+func (opts *options) filter(ids []string) []string {
+	if opts.include == "" && opts.exclude == "" {
+		return ids
+	}
+	return slices.DeleteFunc(ids, func(id string) bool {
+		if opts.include != "" {
+			if ok, _ := path.Match(opts.include, id); !ok {
+				return true
+			}
+		}
+		if opts.exclude != "" {
+			if ok, _ := path.Match(opts.exclude, id); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// collator returns collator of station names or nil for the default byte order.
+func (opts *options) collator() (*collate.Collator, error) {
+	if opts.collate == "" || opts.collate == "byte" {
+		return nil, nil
+	}
+	tag, err := language.Parse(opts.collate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collation: %w", err)
+	}
+	return collate.New(tag), nil
+}
+
+// maxPrecision is the maximum number of decimals, float64 values have about 16 significant digits
+// and scaling by a large power of 10 in roundValue overflows to infinity.
+const maxPrecision = 10
+
+// decimals returns the number of decimals of min, mean and max.
+func (opts *options) decimals() int {
+	if opts.precision <= 0 {
+		return 1
+	}
+	return opts.precision
+}
+
+func sortedIds(measurements map[string]Stats) []string {
+	ids := make([]string, 0, len(measurements))
+	for id := range measurements {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// writeSummary writes the number of processed lines and stations, e.g.
+// processed 1000000000 lines, 413 stations
+func writeSummary(w io.Writer, lines int64, stations int) error {
+	_, err := fmt.Fprintf(w, "processed %d lines, %d stations\n", lines, stations)
+	return err
+}
+
+// writeExtremes writes the stations with the highest max and the lowest min, e.g.
+// hottest: Abha (59.2), coldest: Abidjan (-16.2)
+// Ties are broken by station name, nothing is written if there are no stations.
+func writeExtremes(w io.Writer, measurements map[string]Stats, opts *options) error {
+	ids := sortedIds(measurements)
+	if len(ids) == 0 {
+		return nil
+	}
+	hottest, coldest := ids[0], ids[0]
+	for _, id := range ids[1:] {
+		if measurements[id].Max() > measurements[hottest].Max() {
+			hottest = id
+		}
+		if measurements[id].Min() < measurements[coldest].Min() {
+			coldest = id
+		}
+	}
+	decimals := opts.decimals()
+	_, err := fmt.Fprintf(w, "hottest: %s (%.*f), coldest: %s (%.*f)\n",
+		hottest, decimals, opts.roundValue(measurements[hottest].Max()), coldest, decimals, opts.roundValue(measurements[coldest].Min()))
+	return err
+}
+
+// missingValue returns output value of stations without measurements.
+func (opts *options) missingValue() string {
+	if opts.missing == "" {
+		return "NaN"
+	}
+	return opts.missing
+}
+
+// writeDefault writes measurements in the format of the reference implementation, e.g.
+// {Abha=-23.0/18.0/59.2, Abidjan=-16.2/26.0/67.3, ...}
+func writeDefault(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	return defaultFormat.write(w, ids, measurements, opts)
+}
+
+// writeCompact writes measurements without spaces for minimal size, e.g.
+// Abha:-23.0/18.0/59.2;Abidjan:-16.2/26.0/67.3;...
+func writeCompact(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	return compactFormat.write(w, ids, measurements, opts)
+}
+
+// lineFormat is a single line format of station values separated by "/".
+type lineFormat struct {
+	start, assign, separator, count, end string
+}
+
+var (
+	defaultFormat = lineFormat{start: "{", assign: "=", separator: ", ", count: " (n=", end: "}\n"}
+	compactFormat = lineFormat{assign: ":", separator: ";", count: "(n=", end: "\n"}
+)
+
+// lineFormats are the line formats by format option.
+var lineFormats = map[string]lineFormat{
+	"":        defaultFormat,
+	"default": defaultFormat,
+	"compact": compactFormat,
+}
+
+// write formats the whole output into a single buffer presized for typical values and writes it at once.
+func (f lineFormat) write(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	p := opts.decimals()
+
+	// separators and three values like -12.3 separated by "/"
+	lineSize := len(f.assign) + len(f.separator) + 3*(p+4) + 2
+	if opts.stddev {
+		lineSize += 1 + p + 4
+	}
+	if opts.percentiles {
+		lineSize += 3 * (1 + p + 4)
+	}
+	if opts.count {
+		lineSize += len(f.count) + len(")") + 10
+	}
+	if opts.withTimestamp {
+		lineSize += 2 * (1 + 10)
+	}
+	size := len(f.start) + len(f.end)
+	for _, id := range ids {
+		size += len(id) + lineSize
+	}
+
+	b := make([]byte, 0, size)
+	b = append(b, f.start...)
+	for i, id := range ids {
+		if i > 0 {
+			b = append(b, f.separator...)
+		}
+		s, ok := measurements[id]
+		b = f.appendStats(b, id, s, ok, opts)
+	}
+	b = append(b, f.end...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// appendStats appends station values to b or the missing value if the station has no measurements.
+func (f lineFormat) appendStats(b []byte, id string, s Stats, ok bool, opts *options) []byte {
+	p := opts.decimals()
+	b = append(b, id...)
+	b = append(b, f.assign...)
+	if !ok {
+		return append(b, opts.missingValue()...)
+	}
+	b = strconv.AppendFloat(b, opts.roundValue(s.Min()), 'f', p, 64)
+	b = append(b, '/')
+	b = strconv.AppendFloat(b, opts.roundValue(s.mean()), 'f', p, 64)
+	b = append(b, '/')
+	b = strconv.AppendFloat(b, opts.roundValue(s.Max()), 'f', p, 64)
+	if opts.stddev {
+		b = append(b, '/')
+		b = strconv.AppendFloat(b, opts.roundValue(s.StdDev), 'f', p, 64)
+	}
+	if opts.percentiles {
+		for _, v := range []float64{s.P50, s.P95, s.P99} {
+			b = append(b, '/')
+			b = strconv.AppendFloat(b, opts.roundValue(v), 'f', p, 64)
+		}
+	}
+	if opts.withTimestamp && s.HasTimestamps() {
+		for _, ts := range []int64{s.First, s.Last} {
+			b = append(b, '/')
+			b = strconv.AppendInt(b, ts, 10)
+		}
+	}
+	if opts.count {
+		b = append(b, f.count...)
+		b = strconv.AppendInt(b, s.Count(), 10)
+		b = append(b, ')')
+	}
+	return b
+}
+
+type jsonStats struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	Max  float64 `json:"max"`
+	// StdDev is set when standard deviation output is enabled
+	StdDev *float64 `json:"stddev,omitempty"`
+	// Percentiles are set when percentiles output is enabled
+	P50 *float64 `json:"p50,omitempty"`
+	P95 *float64 `json:"p95,omitempty"`
+	P99 *float64 `json:"p99,omitempty"`
+	// Count is set when count output is enabled
+	Count *int64 `json:"count,omitempty"`
+	// First and Last are set when timestamps are tracked and measured
+	First *int64 `json:"first,omitempty"`
+	Last  *int64 `json:"last,omitempty"`
+}
+
+func newJSONStats(s Stats, opts *options) jsonStats {
+	js := jsonStats{Min: opts.roundValue(s.Min()), Mean: opts.roundValue(s.mean()), Max: opts.roundValue(s.Max())}
+	if opts.stddev {
+		stdDev := opts.roundValue(s.StdDev)
+		js.StdDev = &stdDev
+	}
+	if opts.percentiles {
+		p50, p95, p99 := opts.roundValue(s.P50), opts.roundValue(s.P95), opts.roundValue(s.P99)
+		js.P50, js.P95, js.P99 = &p50, &p95, &p99
+	}
+	if opts.count {
+		count := s.Count()
+		js.Count = &count
+	}
+	if opts.withTimestamp && s.HasTimestamps() {
+		js.First, js.Last = &s.First, &s.Last
+	}
+	return js
+}
+
+// writeJSON writes measurements as a JSON object keyed by station name, e.g.
+// {"Abha":{"min":-23,"mean":18,"max":59.2},"Abidjan":{"min":-16.2,"mean":26,"max":67.3}, ...}
+func writeJSON(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	// stations without measurements are null
+	result := make(map[string]*jsonStats, len(ids))
+	for _, id := range ids {
+		result[id] = newJSONStatsOf(measurements, id, opts)
+	}
+
+	// json encodes map keys in sorted order
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(result)
+}
+
+// jsonEnvelope is the json output with metadata, e.g.
+// {"generatedAt":"2024-01-02T03:04:05Z","file":"measurements.txt","stationCount":413,"stations":{...}}
+type jsonEnvelope struct {
+	GeneratedAt string `json:"generatedAt"`
+	// File is the input file name, Files are the names of multiple input files
+	File         string                `json:"file,omitempty"`
+	Files        []string              `json:"files,omitempty"`
+	StationCount int                   `json:"stationCount"`
+	Stations     map[string]*jsonStats `json:"stations"`
+}
+
+// now is a variable to fix the generation time of the json envelope in tests.
+var now = time.Now
+
+// writeJSONEnvelope writes measurements like writeJSON wrapped with the generation time in RFC 3339 format,
+// input file names and the number of stations which excludes the global statistics.
+func writeJSONEnvelope(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	env := jsonEnvelope{
+		GeneratedAt:  now().UTC().Format(time.RFC3339),
+		StationCount: len(ids),
+		Stations:     make(map[string]*jsonStats, len(ids)),
+	}
+	if opts.global && slices.Contains(ids, globalId) {
+		env.StationCount--
+	}
+	if len(opts.filenames) == 1 {
+		env.File = opts.filenames[0]
+	} else {
+		env.Files = opts.filenames
+	}
+	for _, id := range ids {
+		env.Stations[id] = newJSONStatsOf(measurements, id, opts)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(env)
+}
+
+type ndjsonStats struct {
+	Station string `json:"station"`
+	*jsonStats
+}
+
+// newJSONStatsOf returns JSON stats of the station or nil if it has no measurements.
+func newJSONStatsOf(measurements map[string]Stats, id string, opts *options) *jsonStats {
+	s, ok := measurements[id]
+	if !ok {
+		return nil
+	}
+	js := newJSONStats(s, opts)
+	return &js
+}
+
+// writeNDJSON writes measurements as newline delimited JSON objects in station order, e.g.
+// {"station":"Abha","min":-23,"mean":18,"max":59.2}
+// {"station":"Abidjan","min":-16.2,"mean":26,"max":67.3}
+func writeNDJSON(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for _, id := range ids {
+		if err := enc.Encode(ndjsonStats{Station: id, jsonStats: newJSONStatsOf(measurements, id, opts)}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeCSV writes measurements as RFC 4180 CSV with a header row.
+func writeCSV(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	cw := csv.NewWriter(w)
+	header := recordHeader(opts)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s, ok := measurements[id]
+		if err := cw.Write(statsRecord(id, s, ok, opts)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeTable writes measurements as a table with a header row and columns aligned
+// for reading in a terminal, station names are left-aligned and values right-aligned.
+func writeTable(w io.Writer, ids []string, measurements map[string]Stats, opts *options) error {
+	header := recordHeader(opts)
+	for i, name := range header {
+		header[i] = strings.ToUpper(name[:1]) + name[1:]
+	}
+	rows := [][]string{header}
+	for _, id := range ids {
+		s, ok := measurements[id]
+		rows = append(rows, statsRecord(id, s, ok, opts))
+	}
+
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for i, v := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(v))
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, row := range rows {
+		for i, v := range row {
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v))
+			if i == 0 {
+				bw.WriteString(v)
+				bw.WriteString(pad)
+			} else {
+				bw.WriteString("  ")
+				bw.WriteString(pad)
+				bw.WriteString(v)
+			}
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// recordHeader returns field names of station records.
+func recordHeader(opts *options) []string {
+	header := []string{"station", "min", "mean", "max"}
+	if opts.stddev {
+		header = append(header, "stddev")
+	}
+	if opts.percentiles {
+		header = append(header, "p50", "p95", "p99")
+	}
+	if opts.count {
+		header = append(header, "count")
+	}
+	if opts.withTimestamp {
+		header = append(header, "first", "last")
+	}
+	return header
+}
+
+// statsRecord returns fields of the station record, see recordHeader.
+// Values of station without measurements are the missing value, its count is 0
+// and timestamps are empty like of stations without timestamps.
+func statsRecord(id string, s Stats, ok bool, opts *options) []string {
+	record := []string{id}
+	if !ok {
+		missing := opts.missingValue()
+		record = append(record, missing, missing, missing)
+		if opts.stddev {
+			record = append(record, missing)
+		}
+		if opts.percentiles {
+			record = append(record, missing, missing, missing)
+		}
+		if opts.count {
+			record = append(record, "0")
+		}
+		if opts.withTimestamp {
+			record = append(record, "", "")
+		}
+		return record
+	}
+	p := opts.decimals()
+	record = append(record, fmt.Sprintf("%.*f", p, opts.roundValue(s.Min())), fmt.Sprintf("%.*f", p, opts.roundValue(s.mean())), fmt.Sprintf("%.*f", p, opts.roundValue(s.Max())))
+	if opts.stddev {
+		record = append(record, fmt.Sprintf("%.*f", p, opts.roundValue(s.StdDev)))
+	}
+	if opts.percentiles {
+		record = append(record, fmt.Sprintf("%.*f", p, opts.roundValue(s.P50)), fmt.Sprintf("%.*f", p, opts.roundValue(s.P95)), fmt.Sprintf("%.*f", p, opts.roundValue(s.P99)))
+	}
+	if opts.count {
+		record = append(record, strconv.FormatInt(s.Count(), 10))
+	}
+	if opts.withTimestamp {
+		if s.HasTimestamps() {
+			record = append(record, strconv.FormatInt(s.First, 10), strconv.FormatInt(s.Last, 10))
+		} else {
+			record = append(record, "", "")
+		}
+	}
+	return record
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteDefault(t *testing.T) {
+	filenames, err := filepath.Glob("../../test/resources/samples/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range filenames {
+		expected, err := os.ReadFile(strings.TrimSuffix(filename, ".txt") + ".out")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		measurements, err := Aggregate(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := writeDefault(&buf, sortedIds(measurements), measurements, &options{}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(expected) {
+			t.Errorf("%s: wrong output, expected: %s, got: %s", filename, expected, buf.String())
+		}
+	}
+}
+
+func TestWriteDefaultOptions(t *testing.T) {
+	filename := writeTempFile(t, "Foo;-1.0\nFoo;2.0\nBar;0.5\nFoo;-99.9\nBaz;99.9\nBar;-0.4\n")
+
+	measurements, err := aggregate([]string{filename}, &options{percentiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{options{}, "{Bar=-0.4/0.1/0.5, Baz=99.9/99.9/99.9, Foo=-99.9/-33.0/2.0}\n"},
+		{options{stddev: true, count: true}, "{Bar=-0.4/0.1/0.5/0.5 (n=2), Baz=99.9/99.9/99.9/0.0 (n=1), Foo=-99.9/-33.0/2.0/47.3 (n=3)}\n"},
+		{options{percentiles: true, precision: 2}, "{Bar=-0.40/0.05/0.50/-0.40/0.50/0.50, Baz=99.90/99.90/99.90/99.90/99.90/99.90, Foo=-99.90/-32.97/2.00/-1.00/2.00/2.00}\n"},
+		{options{stddev: true, precision: 3}, "{Bar=-0.400/0.050/0.500/0.450, Baz=99.900/99.900/99.900/0.000, Foo=-99.900/-32.967/2.000/47.345}\n"},
+		{options{stddev: true, rounding: "truncate"}, "{Bar=-0.4/0.0/0.5/0.4, Baz=99.9/99.9/99.9/0.0, Foo=-99.9/-32.9/2.0/47.3}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := writeDefault(&buf, sortedIds(measurements), measurements, &tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %q, got: %q", tc.opts, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRunCompact(t *testing.T) {
+	filename := writeTempFile(t, "Foo;-1.0\nFoo;2.0\nBar;0.5\nFoo;-99.9\nBaz;99.9\nBar;-0.4\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{options{}, "Bar:-0.4/0.1/0.5;Baz:99.9/99.9/99.9;Foo:-99.9/-33.0/2.0\n"},
+		{options{stddev: true, count: true}, "Bar:-0.4/0.1/0.5/0.5(n=2);Baz:99.9/99.9/99.9/0.0(n=1);Foo:-99.9/-33.0/2.0/47.3(n=3)\n"},
+	} {
+		tc.opts.format = "compact"
+
+		var stdout bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &stdout); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %q, got: %q", tc.opts, tc.expected, stdout.String())
+		}
+	}
+}
+
+func BenchmarkWriteDefault(b *testing.B) {
+	measurements, err := Aggregate("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ids := sortedIds(measurements)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := writeDefault(io.Discard, ids, measurements, &options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStatsAccessors(t *testing.T) {
+	filenames, err := filepath.Glob("../../test/resources/samples/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range filenames {
+		measurements, err := Aggregate(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for id, s := range measurements {
+			var buf bytes.Buffer
+			if err := writeDefault(&buf, []string{id}, measurements, &options{}); err != nil {
+				t.Fatal(err)
+			}
+			expected := fmt.Sprintf("{%s=%.1f/%.1f/%.1f}\n", id, s.Min(), s.Mean(), s.Max())
+			if buf.String() != expected {
+				t.Errorf("%s: accessors do not match the output, expected: %s, got: %s", filename, expected, buf.String())
+			}
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	measurements, err := Aggregate("../../test/resources/samples/measurements-complex-utf8.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, sortedIds(measurements), measurements, &options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]jsonStats
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]jsonStats, len(measurements))
+	for id, s := range measurements {
+		expected[id] = jsonStats{Min: s.Min(), Mean: s.Mean(), Max: s.Max()}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong output, expected: %v, got: %v", expected, got)
+	}
+}
+
+func TestRunJSONEnvelope(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	generated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	now = func() time.Time { return generated }
+
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+	measurements, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := run([]string{filename}, &options{format: "json-envelope"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		GeneratedAt  string               `json:"generatedAt"`
+		File         string               `json:"file"`
+		Files        []string             `json:"files"`
+		StationCount int                  `json:"stationCount"`
+		Stations     map[string]jsonStats `json:"stations"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GeneratedAt != "2024-01-02T02:04:05Z" {
+		t.Errorf("Wrong generation time: %s", got.GeneratedAt)
+	}
+	if got.File != filename || got.Files != nil {
+		t.Errorf("Wrong file: %q, files: %q", got.File, got.Files)
+	}
+	if got.StationCount != len(measurements) {
+		t.Errorf("Wrong station count, expected: %d, got: %d", len(measurements), got.StationCount)
+	}
+	expected := make(map[string]jsonStats, len(measurements))
+	for id, s := range measurements {
+		expected[id] = jsonStats{Min: s.Min(), Mean: s.Mean(), Max: s.Max()}
+	}
+	if !reflect.DeepEqual(got.Stations, expected) {
+		t.Error("Wrong stations")
+	}
+
+	buf.Reset()
+	files := []string{writeTempFile(t, "Foo;1.0\n"), writeTempFile(t, "Foo;3.0\n")}
+	if err := run(files, &options{format: "json-envelope"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expectedEnvelope := fmt.Sprintf(`{"generatedAt":"2024-01-02T02:04:05Z","files":["%s","%s"],"stationCount":1,"stations":{"Foo":{"min":1,"mean":2,"max":3}}}`+"\n", files[0], files[1])
+	if buf.String() != expectedEnvelope {
+		t.Errorf("Wrong envelope, expected: %s, got: %s", expectedEnvelope, buf.String())
+	}
+
+	// global statistics are not a station
+	buf.Reset()
+	if err := run(files[:1], &options{format: "json-envelope", global: true}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expectedEnvelope = fmt.Sprintf(`{"generatedAt":"2024-01-02T02:04:05Z","file":"%s","stationCount":1,"stations":{"Foo":{"min":1,"mean":1,"max":1},"__global__":{"min":1,"mean":1,"max":1}}}`+"\n", files[0])
+	if buf.String() != expectedEnvelope {
+		t.Errorf("Wrong envelope with global statistics, expected: %s, got: %s", expectedEnvelope, buf.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	measurements, err := Aggregate(writeTempFile(t, "Foo, Bar;1.5\nBaz;-2.0\nFoo, Bar;2.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, sortedIds(measurements), measurements, &options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "station,min,mean,max\n" +
+		"Baz,-2.0,-2.0,-2.0\n" +
+		"\"Foo, Bar\",1.5,1.8,2.0\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, buf.String())
+	}
+}
+
+func TestWriteCSVStdDev(t *testing.T) {
+	measurements, err := Aggregate(writeTempFile(t, "Foo;2.0\nFoo;4.0\nFoo;4.0\nFoo;4.0\nFoo;5.0\nFoo;5.0\nFoo;7.0\nFoo;9.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{options{stddev: true}, "station,min,mean,max,stddev\nFoo,2.0,5.0,9.0,2.0\n"},
+		{options{stddev: true, precision: 2}, "station,min,mean,max,stddev\nFoo,2.00,5.00,9.00,2.00\n"},
+	} {
+		var buf bytes.Buffer
+		if err := writeCSV(&buf, sortedIds(measurements), measurements, &tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %q, got: %q", tc.opts, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	measurements, err := Aggregate("../../test/resources/samples/measurements-complex-utf8.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeNDJSON(&buf, sortedIds(measurements), measurements, &options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(measurements) {
+		t.Fatalf("Wrong number of lines, expected: %d, got: %d", len(measurements), len(lines))
+	}
+	for i, id := range sortedIds(measurements) {
+		// json can not decode into embedded pointer to unexported type
+		var got, expected struct {
+			Station string `json:"station"`
+			jsonStats
+		}
+		if err := json.Unmarshal([]byte(lines[i]), &got); err != nil {
+			t.Fatalf("Line %d: %v", i+1, err)
+		}
+
+		s := measurements[id]
+		expected.Station, expected.jsonStats = id, jsonStats{Min: s.Min(), Mean: s.Mean(), Max: s.Max()}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Line %d: wrong output, expected: %v, got: %v", i+1, expected, got)
+		}
+	}
+}
+
+func TestWriteCount(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		id, _, _ := strings.Cut(line, ";")
+		expected[id]++
+	}
+
+	var buf bytes.Buffer
+	if err := run([]string{filename}, &options{format: "json", count: true}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]jsonStats
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Wrong number of stations, expected: %d, got: %d", len(expected), len(got))
+	}
+	for id, n := range expected {
+		if js := got[id]; js.Count == nil || *js.Count != n {
+			t.Errorf("Wrong %s count, expected: %d, got: %v", id, n, js.Count)
+		}
+	}
+}
+
+func TestWriteCountFormats(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;2.0\nFoo;3.0\n")
+
+	for _, tc := range []struct {
+		format   string
+		expected string
+	}{
+		{format: "default", expected: "{Bar=2.0/2.0/2.0 (n=1), Foo=1.0/2.0/3.0 (n=2)}\n"},
+		{format: "json", expected: `{"Bar":{"min":2,"mean":2,"max":2,"count":1},"Foo":{"min":1,"mean":2,"max":3,"count":2}}` + "\n"},
+		{format: "ndjson", expected: `{"station":"Bar","min":2,"mean":2,"max":2,"count":1}` + "\n" + `{"station":"Foo","min":1,"mean":2,"max":3,"count":2}` + "\n"},
+		{format: "csv", expected: "station,min,mean,max,count\nBar,2.0,2.0,2.0,1\nFoo,1.0,2.0,3.0,2\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &options{format: tc.format, count: true}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong %s output, expected: %q, got: %q", tc.format, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRunSort(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;-5.0\nBaz;3.0\nFoo;9.0\nQux;-5.0\nQux;9.0\nBaz;3.0\n")
+
+	for _, tc := range []struct {
+		sort     string
+		expected string
+	}{
+		{sort: "", expected: "{Bar=-5.0/-5.0/-5.0, Baz=3.0/3.0/3.0, Foo=1.0/5.0/9.0, Qux=-5.0/2.0/9.0}\n"},
+		{sort: "name", expected: "{Bar=-5.0/-5.0/-5.0, Baz=3.0/3.0/3.0, Foo=1.0/5.0/9.0, Qux=-5.0/2.0/9.0}\n"},
+		{sort: "min", expected: "{Bar=-5.0/-5.0/-5.0, Qux=-5.0/2.0/9.0, Foo=1.0/5.0/9.0, Baz=3.0/3.0/3.0}\n"},
+		{sort: "mean", expected: "{Foo=1.0/5.0/9.0, Baz=3.0/3.0/3.0, Qux=-5.0/2.0/9.0, Bar=-5.0/-5.0/-5.0}\n"},
+		{sort: "max", expected: "{Foo=1.0/5.0/9.0, Qux=-5.0/2.0/9.0, Baz=3.0/3.0/3.0, Bar=-5.0/-5.0/-5.0}\n"},
+		{sort: "first-seen", expected: "{Foo=1.0/5.0/9.0, Bar=-5.0/-5.0/-5.0, Baz=3.0/3.0/3.0, Qux=-5.0/2.0/9.0}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &options{sort: tc.sort}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output sorted by %q, expected: %s, got: %s", tc.sort, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRunSortFirstSeen(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	var expected []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if id, _, _ := strings.Cut(line, ";"); !seen[id] {
+			seen[id] = true
+			expected = append(expected, id)
+		}
+	}
+	// stations of the second file follow in their first-seen order unless seen in the first one
+	second := writeTempFile(t, "Zzz;1.0\n"+expected[0]+";2.0\nAaa;3.0\n")
+	expected = append(expected, "Zzz", "Aaa")
+
+	for _, opts := range []options{
+		{sort: "first-seen", workers: 1},
+		{sort: "first-seen", workers: 4, chunkBytes: 4096},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename, second}, &opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, s := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(buf.String(), "{"), "}\n"), ", ") {
+			id, _, _ := strings.Cut(s, "=")
+			ids = append(ids, id)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Wrong first-seen order with %d workers", opts.workers)
+		}
+	}
+}
+
+func TestRunFilter(t *testing.T) {
+	filename := writeTempFile(t, "Berlin;1.0\nBarcelona;20.0\nDublin;5.0\nBern;-2.0\nBerlin;3.0\nOslo;-5.0\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{opts: options{include: "B*"}, expected: "{Barcelona=20.0/20.0/20.0, Berlin=1.0/2.0/3.0, Bern=-2.0/-2.0/-2.0}\n"},
+		{opts: options{exclude: "*lin"}, expected: "{Barcelona=20.0/20.0/20.0, Bern=-2.0/-2.0/-2.0, Oslo=-5.0/-5.0/-5.0}\n"},
+		{opts: options{include: "B*", exclude: "*lin"}, expected: "{Barcelona=20.0/20.0/20.0, Bern=-2.0/-2.0/-2.0}\n"},
+		{opts: options{include: "Ber?", sort: "max"}, expected: "{Bern=-2.0/-2.0/-2.0}\n"},
+		{opts: options{include: "B*", sort: "max", top: 2}, expected: "{Barcelona=20.0/20.0/20.0, Berlin=1.0/2.0/3.0}\n"},
+		{opts: options{include: "[A-C]*", format: "csv"}, expected: "station,min,mean,max\nBarcelona,20.0,20.0,20.0\nBerlin,1.0,2.0,3.0\nBern,-2.0,-2.0,-2.0\n"},
+		{opts: options{include: "Z*"}, expected: "{}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %s, got: %s", tc.opts, tc.expected, buf.String())
+		}
+	}
+
+	if err := run([]string{filename}, &options{include: "[B"}, io.Discard); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
+
+func TestRunTop(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;-5.0\nBaz;3.0\nFoo;9.0\nQux;-5.0\nQux;9.5\nBaz;3.0\nZed;4.0\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{opts: options{sort: "max", top: 3}, expected: "{Qux=-5.0/2.3/9.5, Foo=1.0/5.0/9.0, Zed=4.0/4.0/4.0}\n"},
+		{opts: options{sort: "min", top: 1}, expected: "{Bar=-5.0/-5.0/-5.0}\n"},
+		{opts: options{top: 2}, expected: "{Bar=-5.0/-5.0/-5.0, Baz=3.0/3.0/3.0}\n"},
+		{opts: options{sort: "max", top: 10}, expected: "{Qux=-5.0/2.3/9.5, Foo=1.0/5.0/9.0, Zed=4.0/4.0/4.0, Baz=3.0/3.0/3.0, Bar=-5.0/-5.0/-5.0}\n"},
+		{opts: options{sort: "max", top: -1}, expected: "{Qux=-5.0/2.3/9.5, Foo=1.0/5.0/9.0, Zed=4.0/4.0/4.0, Baz=3.0/3.0/3.0, Bar=-5.0/-5.0/-5.0}\n"},
+		{opts: options{sort: "max", top: 2, format: "csv"}, expected: "station,min,mean,max\nQux,-5.0,2.3,9.5\nFoo,1.0,5.0,9.0\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %s, got: %s", tc.opts, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRunUnknownSort(t *testing.T) {
+	if err := run([]string{"../../test/resources/samples/measurements-20.txt"}, &options{sort: "median"}, io.Discard); err == nil {
+		t.Error("Expected error for unknown sort order")
+	}
+}
+
+func TestRunCollate(t *testing.T) {
+	filename := writeTempFile(t, "Zurich;1.0\nÄrhus;2.0\nAbha;3.0\nÉcija;4.0\n")
+
+	for _, tc := range []struct {
+		collate  string
+		expected string
+	}{
+		{collate: "", expected: "{Abha=3.0/3.0/3.0, Zurich=1.0/1.0/1.0, Ärhus=2.0/2.0/2.0, Écija=4.0/4.0/4.0}\n"},
+		{collate: "byte", expected: "{Abha=3.0/3.0/3.0, Zurich=1.0/1.0/1.0, Ärhus=2.0/2.0/2.0, Écija=4.0/4.0/4.0}\n"},
+		{collate: "und", expected: "{Abha=3.0/3.0/3.0, Ärhus=2.0/2.0/2.0, Écija=4.0/4.0/4.0, Zurich=1.0/1.0/1.0}\n"},
+		{collate: "de", expected: "{Abha=3.0/3.0/3.0, Ärhus=2.0/2.0/2.0, Écija=4.0/4.0/4.0, Zurich=1.0/1.0/1.0}\n"},
+		// Swedish sorts Ä after Z
+		{collate: "sv", expected: "{Abha=3.0/3.0/3.0, Écija=4.0/4.0/4.0, Zurich=1.0/1.0/1.0, Ärhus=2.0/2.0/2.0}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &options{collate: tc.collate}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output collated by %q, expected: %s, got: %s", tc.collate, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRunInvalidCollate(t *testing.T) {
+	if err := run([]string{"../../test/resources/samples/measurements-20.txt"}, &options{collate: "not a language"}, io.Discard); err == nil {
+		t.Error("Expected error for invalid collation")
+	}
+}
+
+func TestRunPrecision(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nFoo;0.0\nFoo;0.0\nBar;-2.0\nBar;0.0\nBar;0.0\nBaz;1.0\nBaz;1.1\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{opts: options{}, expected: "{Bar=-2.0/-0.7/0.0, Baz=1.0/1.1/1.1, Foo=0.0/0.3/1.0}\n"},
+		{opts: options{precision: 1}, expected: "{Bar=-2.0/-0.7/0.0, Baz=1.0/1.1/1.1, Foo=0.0/0.3/1.0}\n"},
+		{opts: options{precision: 2}, expected: "{Bar=-2.00/-0.67/0.00, Baz=1.00/1.05/1.10, Foo=0.00/0.33/1.00}\n"},
+		{opts: options{precision: 3}, expected: "{Bar=-2.000/-0.667/0.000, Baz=1.000/1.050/1.100, Foo=0.000/0.333/1.000}\n"},
+		{opts: options{precision: 2, format: "csv"}, expected: "station,min,mean,max\nBar,-2.00,-0.67,0.00\nBaz,1.00,1.05,1.10\nFoo,0.00,0.33,1.00\n"},
+		{opts: options{precision: 2, format: "json"}, expected: `{"Bar":{"min":-2,"mean":-0.67,"max":0},"Baz":{"min":1,"mean":1.05,"max":1.1},"Foo":{"min":0,"mean":0.33,"max":1}}` + "\n"},
+		{opts: options{precision: maxPrecision}, expected: "{Bar=-2.0000000000/-0.6666666667/0.0000000000, Baz=1.0000000000/1.0500000000/1.1000000000, Foo=0.0000000000/0.3333333333/1.0000000000}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with precision %d, expected: %s, got: %s", tc.opts.precision, tc.expected, buf.String())
+		}
+	}
+
+	if err := run([]string{filename}, &options{precision: maxPrecision + 1}, io.Discard); err == nil {
+		t.Errorf("Expected error for precision %d", maxPrecision+1)
+	}
+}
+
+func TestRunRounding(t *testing.T) {
+	filename := writeTempFile(t, "Foo;2.2\nFoo;2.3\nBar;-2.2\nBar;-2.3\nBaz;0.0\nBaz;-0.1\n")
+
+	for _, tc := range []struct {
+		rounding, expected string
+	}{
+		{rounding: "", expected: "{Bar=-2.3/-2.2/-2.2, Baz=-0.1/0.0/0.0, Foo=2.2/2.3/2.3}\n"},
+		{rounding: "half-up", expected: "{Bar=-2.3/-2.2/-2.2, Baz=-0.1/0.0/0.0, Foo=2.2/2.3/2.3}\n"},
+		{rounding: "half-even", expected: "{Bar=-2.3/-2.2/-2.2, Baz=-0.1/0.0/0.0, Foo=2.2/2.2/2.3}\n"},
+		{rounding: "truncate", expected: "{Bar=-2.3/-2.2/-2.2, Baz=-0.1/0.0/0.0, Foo=2.2/2.2/2.3}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &options{rounding: tc.rounding}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with rounding %q, expected: %s, got: %s", tc.rounding, tc.expected, buf.String())
+		}
+	}
+
+	if err := run([]string{filename}, &options{rounding: "up"}, io.Discard); err == nil {
+		t.Error("Expected error for unknown rounding")
+	}
+}
+
+func TestRunFahrenheit(t *testing.T) {
+	filename := writeTempFile(t, "Water;32.0\nWater;212.0\nBody;98.6\nCold;-40\nCold;33.0\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{
+			opts:     options{fahrenheit: true, verify: true},
+			expected: "{Body=37.0/37.0/37.0, Cold=-40.0/-19.7/0.6, Water=0.0/50.0/100.0}\n",
+		},
+		{
+			opts:     options{fahrenheit: true, precision: 2},
+			expected: "{Body=37.00/37.00/37.00, Cold=-40.00/-19.72/0.56, Water=0.00/50.00/100.00}\n",
+		},
+		{
+			opts:     options{fahrenheit: true, precision: 2, rounding: "truncate"},
+			expected: "{Body=37.00/37.00/37.00, Cold=-40.00/-19.72/0.55, Water=0.00/50.00/100.00}\n",
+		},
+		{
+			opts: options{fahrenheit: true, format: "json", stddev: true, percentiles: true},
+			expected: `{"Body":{"min":37,"mean":37,"max":37,"stddev":0,"p50":37,"p95":37,"p99":37},` +
+				`"Cold":{"min":-40,"mean":-19.7,"max":0.6,"stddev":20.3,"p50":-40,"p95":0.6,"p99":0.6},` +
+				`"Water":{"min":0,"mean":50,"max":100,"stddev":50,"p50":0,"p95":100,"p99":100}}` + "\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %s, got: %s", tc.opts, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		x, scale, expected float64
+	}{
+		{2.25, 10, 22}, {-2.25, 10, -22}, {0.3, 10, 3}, {-0.3, 10, -3}, {0.57, 100, 57}, {2.99, 1, 2},
+	} {
+		if got := truncate(tc.x * tc.scale); got != tc.expected {
+			t.Errorf("Wrong truncation of %v*%v, expected: %v, got: %v", tc.x, tc.scale, tc.expected, got)
+		}
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Count(data, []byte("\n"))
+	stations := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		id, _, _ := strings.Cut(line, ";")
+		stations[id] = true
+	}
+
+	expected := fmt.Sprintf("processed %d lines, %d stations\n", lines, len(stations))
+	for _, workers := range []int{1, 3} {
+		var stderr bytes.Buffer
+		if err := run([]string{filename}, &options{workers: workers, summary: true, stderr: &stderr}, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if stderr.String() != expected {
+			t.Errorf("Wrong summary with %d workers, expected: %q, got: %q", workers, expected, stderr.String())
+		}
+	}
+}
+
+func TestRunSummarySkipped(t *testing.T) {
+	const input = "# comment\nHamburg;12.0\nBulawayo;80.9\nHamburg;\nHamburg;NaN\nBulawayo;1.5"
+
+	for _, opts := range []*options{
+		{ignoreComments: true, missingValues: "skip"},
+		{ignoreComments: true, missingValues: "skip", workers: 3},
+		{ignoreComments: true, missingValues: "skip", tempFilter: true, minTemp: -500, maxTemp: 500},
+	} {
+		var stderr bytes.Buffer
+		opts.summary, opts.stderr = true, &stderr
+		if err := run([]string{writeTempFile(t, input)}, opts, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if expected := "processed 6 lines, 2 stations\n"; stderr.String() != expected {
+			t.Errorf("Wrong summary with %+v, expected: %q, got: %q", *opts, expected, stderr.String())
+		}
+	}
+}
+
+func TestRunExtremes(t *testing.T) {
+	filename := writeTempFile(t, "Oslo;-3.2\nDubai;41.5\nOslo;-12.7\nLima;19.0\nDubai;30.1\n")
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{filename}, &options{extremes: true, stderr: &stderr}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "hottest: Dubai (41.5), coldest: Oslo (-12.7)\n"; stderr.String() != expected {
+		t.Errorf("Wrong extremes, expected: %q, got: %q", expected, stderr.String())
+	}
+	if expected := "{Dubai=30.1/35.8/41.5, Lima=19.0/19.0/19.0, Oslo=-12.7/-7.9/-3.2}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+}
+
+func TestWriteExtremesTies(t *testing.T) {
+	measurements := statsOf(map[string]*measurement{
+		"B": {min: -50, max: 90, sum: 40, count: 2},
+		"A": {min: -10, max: 90, sum: 80, count: 2},
+		"C": {min: -50, max: 10, sum: -40, count: 2},
+	})
+
+	var buf bytes.Buffer
+	if err := writeExtremes(&buf, measurements, &options{precision: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "hottest: A (9.00), coldest: B (-5.00)\n"; buf.String() != expected {
+		t.Errorf("Wrong extremes, expected: %q, got: %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := writeExtremes(&buf, map[string]Stats{}, &options{}); err != nil || buf.Len() != 0 {
+		t.Errorf("Unexpected extremes of no stations: %q, %v", buf.String(), err)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	measurements := map[string]Stats{
+		"A":       statsOf(map[string]*measurement{"A": {min: -123, max: 45, sum: -78, count: 2}})["A"],
+		"Ärhus":   statsOf(map[string]*measurement{"Ärhus": {min: 5, max: 5, sum: 5, count: 1}})["Ärhus"],
+		"Beijing": statsOf(map[string]*measurement{"Beijing": {min: 100, max: 300, sum: 600, count: 3}})["Beijing"],
+	}
+
+	var buf bytes.Buffer
+	if err := writeTable(&buf, []string{"A", "Beijing", "Ärhus", "Zürich"}, measurements, &options{count: true}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"Station    Min  Mean   Max  Count\n" +
+		"A        -12.3  -3.9   4.5      2\n" +
+		"Beijing   10.0  20.0  30.0      3\n" +
+		"Ärhus      0.5   0.5   0.5      1\n" +
+		"Zürich     NaN   NaN   NaN      0\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong table, expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestRunChecksum(t *testing.T) {
+	filename := writeMeasurements(t, 10_000, 1)
+
+	var checksum string
+	for _, workers := range []int{1, 3, 16} {
+		var stdout, stderr bytes.Buffer
+		if err := run([]string{filename}, &options{workers: workers, checksum: true, stderr: &stderr}, &stdout); err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("sha256 %x\n", sha256.Sum256(stdout.Bytes())); stderr.String() != expected {
+			t.Errorf("Wrong checksum with %d workers, expected: %q, got: %q", workers, expected, stderr.String())
+		}
+		if checksum == "" {
+			checksum = stderr.String()
+		} else if stderr.String() != checksum {
+			t.Errorf("Checksum with %d workers differs, expected: %q, got: %q", workers, checksum, stderr.String())
+		}
+	}
+}
+
+func TestRunNegativeZero(t *testing.T) {
+	// Foo is -0.0, mean of Bar is -0.04, mean of Baz is -0.05 which rounds to zero like Java's Math.round
+	filename := writeTempFile(t, "Foo;-0.0\nBar;-0.1\nBar;0.0\nBar;-0.1\nBar;0.0\nBar;0.0\nBaz;-0.1\nBaz;0.0\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{opts: options{}, expected: "{Bar=-0.1/0.0/0.0, Baz=-0.1/0.0/0.0, Foo=0.0/0.0/0.0}\n"},
+		{opts: options{precision: 2}, expected: "{Bar=-0.10/-0.04/0.00, Baz=-0.10/-0.05/0.00, Foo=0.00/0.00/0.00}\n"},
+		{opts: options{stddev: true, percentiles: true}, expected: "{Bar=-0.1/0.0/0.0/0.0/0.0/0.0/0.0, Baz=-0.1/0.0/0.0/0.1/-0.1/0.0/0.0, Foo=0.0/0.0/0.0/0.0/0.0/0.0/0.0}\n"},
+		{opts: options{format: "csv"}, expected: "station,min,mean,max\nBar,-0.1,0.0,0.0\nBaz,-0.1,0.0,0.0\nFoo,0.0,0.0,0.0\n"},
+		{opts: options{format: "json"}, expected: `{"Bar":{"min":-0.1,"mean":0,"max":0},"Baz":{"min":-0.1,"mean":0,"max":0},"Foo":{"min":0,"mean":0,"max":0}}` + "\n"},
+	} {
+		var buf bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("Wrong output with %+v, expected: %s, got: %s", tc.opts, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRunGlobal(t *testing.T) {
+	// mean of station means is 5.0 while mean weighted by count is 7.5
+	filename := writeTempFile(t, "Foo;10.0\nFoo;10.0\nBar;0.0\nFoo;10.0\n")
+
+	var stdout bytes.Buffer
+	if err := run([]string{filename}, &options{global: true, count: true}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Bar=0.0/0.0/0.0 (n=1), Foo=10.0/10.0/10.0 (n=3), __global__=0.0/7.5/10.0 (n=4)}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+
+	// global aggregate follows the top stations
+	stdout.Reset()
+	if err := run([]string{filename}, &options{global: true, sort: "max", top: 1, percentiles: true, format: "csv"}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "station,min,mean,max,p50,p95,p99\nFoo,10.0,10.0,10.0,10.0,10.0,10.0\n__global__,0.0,7.5,10.0,10.0,10.0,10.0\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+}
+
+func TestRunStationsFile(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;2.0\nBaz;3.0\n")
+	stationsFile := writeTempFile(t, "Foo\r\nQux\n\nBar\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{options{}, "{Foo=1.0/1.0/1.0, Qux=NaN, Bar=2.0/2.0/2.0}\n"},
+		{options{missing: "no data", sort: "max"}, "{Foo=1.0/1.0/1.0, Qux=no data, Bar=2.0/2.0/2.0}\n"},
+		{options{format: "csv", count: true}, "station,min,mean,max,count\nFoo,1.0,1.0,1.0,1\nQux,NaN,NaN,NaN,0\nBar,2.0,2.0,2.0,1\n"},
+		{options{format: "csv", stddev: true, count: true, withTimestamp: true, missing: "-"}, "station,min,mean,max,stddev,count,first,last\nFoo,1.0,1.0,1.0,0.0,1,,\nQux,-,-,-,-,0,,\nBar,2.0,2.0,2.0,0.0,1,,\n"},
+		{options{format: "json"}, `{"Bar":{"min":2,"mean":2,"max":2},"Foo":{"min":1,"mean":1,"max":1},"Qux":null}` + "\n"},
+		{options{format: "ndjson"}, `{"station":"Foo","min":1,"mean":1,"max":1}` + "\n" + `{"station":"Qux"}` + "\n" + `{"station":"Bar","min":2,"mean":2,"max":2}` + "\n"},
+	} {
+		tc.opts.stationsFile = stationsFile
+
+		var stdout bytes.Buffer
+		if err := run([]string{filename}, &tc.opts, &stdout); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != tc.expected {
+			t.Errorf("Wrong output with %s format, expected: %q, got: %q", tc.opts.format, tc.expected, stdout.String())
+		}
+	}
+
+	if err := run([]string{filename}, &options{stationsFile: filepath.Join(t.TempDir(), "missing.txt")}, io.Discard); err == nil {
+		t.Error("Expected error for missing stations file")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks number of processed input bytes.
+type progress struct {
+	processed atomic.Int64
+	// total is the input size if known
+	total atomic.Int64
+}
+
+// report periodically writes progress to w until stopped.
+func (p *progress) report(w io.Writer, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintln(w, p)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (p *progress) String() string {
+	processed, total := p.processed.Load(), p.total.Load()
+	if total > 0 {
+		return fmt.Sprintf("processed %.1f%% (%d of %d bytes)", 100*float64(processed)/float64(total), processed, total)
+	}
+	return fmt.Sprintf("processed %d bytes", processed)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessProgress(t *testing.T) {
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &options{workers: 4, progress: new(progress)}
+	mustProcess(t, data, opts)
+
+	if processed := opts.progress.processed.Load(); processed != int64(len(data)) {
+		t.Errorf("Wrong number of processed bytes, expected: %d, got: %d", len(data), processed)
+	}
+}
+
+func TestProgressReport(t *testing.T) {
+	var p progress
+	p.total.Store(200)
+	p.processed.Store(50)
+
+	var w syncBuffer
+	stop := p.report(&w, time.Millisecond)
+	for !strings.Contains(w.String(), "\n") {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	const expected = "processed 25.0% (50 of 200 bytes)\n"
+	if line := w.String()[:len(expected)]; line != expected {
+		t.Errorf("Wrong progress report, expected: %q, got: %q", expected, line)
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
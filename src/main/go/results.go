@@ -0,0 +1,17 @@
+package main
+
+import "iter"
+
+// Results maps station names to their statistics.
+type Results map[string]Stats
+
+// All returns iterator over station names and statistics ordered by name.
+func (r Results) All() iter.Seq2[string, Stats] {
+	return func(yield func(string, Stats) bool) {
+		for _, id := range sortedIds(r) {
+			if !yield(id, r[id]) {
+				return
+			}
+		}
+	}
+}
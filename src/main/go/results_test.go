@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestResultsAll(t *testing.T) {
+	results, err := Aggregate("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	collected := make(map[string]Stats, len(results))
+	for id, s := range results.All() {
+		ids = append(ids, id)
+		collected[id] = s
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Error("Stations are not ordered by name")
+	}
+	if !reflect.DeepEqual(collected, map[string]Stats(results)) {
+		t.Error("Collected stations differ from results")
+	}
+
+	// stops when the loop breaks
+	n := 0
+	for range results.All() {
+		if n++; n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("Wrong number of iterations, expected: 3, got: %d", n)
+	}
+}
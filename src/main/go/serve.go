@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout limits waiting for active requests on server shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// serve aggregates the files like run and serves the JSON result over HTTP on addr until ctx is done.
+func serve(ctx context.Context, addr string, filenames []string, opts *options) error {
+	body, err := serveBody(filenames, opts)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           newHandler(body),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveBody returns the result of run in JSON format, or JSON envelope format if set,
+// so that serve mode validates and applies options like printing of the result.
+func serveBody(filenames []string, opts *options) ([]byte, error) {
+	if err := opts.checkServe(); err != nil {
+		return nil, err
+	}
+	serveOpts := *opts
+	if serveOpts.format == "" || serveOpts.format == "default" {
+		serveOpts.format = "json"
+	}
+	var body bytes.Buffer
+	if err := run(filenames, &serveOpts, &body); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// checkServe returns error if options do not produce a JSON result to serve.
+func (opts *options) checkServe() error {
+	switch opts.format {
+	case "", "default", "json", "json-envelope":
+	default:
+		return fmt.Errorf("serve is not supported with %s format", opts.format)
+	}
+	for _, o := range []struct {
+		enabled bool
+		flag    string
+	}{
+		{opts.output != "", "-output"},
+		{opts.dryRun != nil, "-dry-run"},
+	} {
+		if o.enabled {
+			return fmt.Errorf("serve is not supported with %s", o.flag)
+		}
+	}
+	return nil
+}
+
+// newHandler returns handler that serves the JSON body on GET /stats
+// and health check on GET /healthz.
+func newHandler(body []byte) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// the response is already committed so the error can not be reported to the client
+		_, _ = w.Write(body)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-complex-utf8.txt"
+	measurements, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := serveBody([]string{filename}, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(newHandler(body))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Wrong /stats status: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Wrong /stats content type: %s", ct)
+	}
+
+	var got map[string]jsonStats
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]jsonStats, len(measurements))
+	for id, s := range measurements {
+		expected[id] = jsonStats{Min: s.Min(), Mean: s.Mean(), Max: s.Max()}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong /stats payload, expected: %v, got: %v", expected, got)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodPost, "/stats", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/missing", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Wrong %s %s status, expected: %d, got: %d", tc.method, tc.path, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestServeBody(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;-2.0\nFoo;2.0\nBaz;3.0\nFoo;2.0\n")
+
+	for _, tc := range []struct {
+		opts     options
+		expected string
+	}{
+		{opts: options{}, expected: `{"Bar":{"min":-2,"mean":-2,"max":-2},"Baz":{"min":3,"mean":3,"max":3},"Foo":{"min":1,"mean":1.7,"max":2}}` + "\n"},
+		{opts: options{precision: 2, rounding: "truncate"}, expected: `{"Bar":{"min":-2,"mean":-2,"max":-2},"Baz":{"min":3,"mean":3,"max":3},"Foo":{"min":1,"mean":1.66,"max":2}}` + "\n"},
+		{opts: options{include: "B*", exclude: "Baz"}, expected: `{"Bar":{"min":-2,"mean":-2,"max":-2}}` + "\n"},
+		{opts: options{format: "json", sort: "max", top: 1}, expected: `{"Baz":{"min":3,"mean":3,"max":3}}` + "\n"},
+	} {
+		body, err := serveBody([]string{filename}, &tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.expected {
+			t.Errorf("Wrong body with %+v, expected: %s, got: %s", tc.opts, tc.expected, body)
+		}
+	}
+
+	if _, err := serveBody([]string{writeTempFile(t, "Foo;1.25\n")}, &options{strict: true}); err == nil {
+		t.Error("Expected error for malformed line in strict mode")
+	}
+	for _, opts := range []options{
+		{rounding: "up"},
+		{format: "csv"},
+		{output: filepath.Join(t.TempDir(), "out.json")},
+		{dryRun: new(dryRun)},
+	} {
+		if _, err := serveBody([]string{filename}, &opts); err == nil {
+			t.Errorf("Expected error with %+v", opts)
+		}
+	}
+}
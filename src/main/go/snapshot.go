@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// snapshotMagic starts snapshot files followed by station measurements encoded by appendRecord.
+const snapshotMagic = "1brc snapshot 1\n"
+
+// saveSnapshot writes measurements to the file replacing it at once so that
+// the previous snapshot stays intact on failure.
+func saveSnapshot(filename string, measurements map[string]*measurement) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	w.WriteString(snapshotMagic)
+	var b []byte
+	for _, id := range slices.Sorted(maps.Keys(measurements)) {
+		b = appendRecord(b[:0], id, measurements[id])
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// loadSnapshot reads measurements written by saveSnapshot.
+func loadSnapshot(filename string) (map[string]*measurement, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, []byte(snapshotMagic)) {
+		return nil, fmt.Errorf("not a snapshot: %s", filename)
+	}
+
+	measurements := make(map[string]*measurement)
+	for {
+		id, m, err := readRecord(r)
+		if err == io.EOF {
+			return measurements, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("malformed snapshot %s: %w", filename, err)
+		}
+		mergeMeasurement(measurements, []byte(id), m)
+	}
+}
+
+// maxSafeCount is the number of measurements of a station that snapshots can accumulate
+// without overflow of the sum of squares of temperatures within the reference range
+// of [-99.9, 99.9] degrees, i.e. about 9.2 trillion. The count itself overflows
+// at math.MaxInt64, mergeSnapshot returns error on any overflow.
+const maxSafeCount = math.MaxInt64 / (999 * 999)
+
+// mergeSnapshot merges prior measurements of a loaded snapshot into dst.
+// It returns error if a count or sum of the merged station overflows int64.
+func mergeSnapshot(dst, prior map[string]*measurement) error {
+	for id, pm := range prior {
+		m := dst[id]
+		if m == nil {
+			dst[id] = pm
+			continue
+		}
+		if addOverflows(m.count, pm.count) || addOverflows(m.sum, pm.sum) || addOverflows(m.sumSquares, pm.sumSquares) {
+			return fmt.Errorf("measurements of station %q overflow int64, up to %d measurements per station are supported", id, int64(maxSafeCount))
+		}
+		m.merge(pm)
+	}
+	return nil
+}
+
+// addOverflows reports whether a+b overflows int64.
+func addOverflows(a, b int64) bool {
+	return b > 0 && a > math.MaxInt64-b || b < 0 && a < math.MinInt64-b
+}
+
+// checkSnapshot returns error if options need measurement state that is not saved in snapshots.
+func (opts *options) checkSnapshot() error {
+	for _, o := range []struct {
+		enabled bool
+		flag    string
+	}{
+		{opts.percentiles, "-percentiles"},
+		{opts.sort == "first-seen", "-sort=first-seen"},
+		{opts.maxMemory > 0, "-max-memory"},
+		{opts.verify && opts.load != "", "-verify"},
+		{opts.dryRun != nil, "-dry-run"},
+	} {
+		if o.enabled {
+			return fmt.Errorf("snapshots are not supported with %s", o.flag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunSnapshot(t *testing.T) {
+	const a = "Hamburg;12.0;1700000100\nBulawayo;8.9;1700000000\nHamburg;-3.4\n"
+	const b = "Hamburg;34.2;1700000300\nPalembang;38.8\nBulawayo;-1.5;1700000200\n"
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+
+	opts := options{withTimestamp: true, format: "compact", count: true, stddev: true}
+	var discard bytes.Buffer
+	saveOpts := opts
+	saveOpts.save = snapshot
+	if err := run([]string{writeTempFile(t, a)}, &saveOpts, &discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	loadOpts := opts
+	loadOpts.load, loadOpts.save = snapshot, snapshot
+	if err := run([]string{writeTempFile(t, b)}, &loadOpts, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected bytes.Buffer
+	if err := run([]string{writeTempFile(t, a+b)}, &opts, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != expected.String() {
+		t.Errorf("Wrong incremental output, expected: %q, got: %q", expected.String(), got.String())
+	}
+
+	// the snapshot is replaced by the merged measurements
+	saved, err := loadSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := processFiles([]string{writeTempFile(t, a+b)}, &options{withTimestamp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, all) {
+		t.Errorf("Wrong saved measurements, expected: %v, got: %v", all, saved)
+	}
+	if entries, err := os.ReadDir(filepath.Dir(snapshot)); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("Temporary snapshot files are not removed: %v", entries)
+	}
+}
+
+func TestRunSnapshotSummary(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	prior := map[string]*measurement{
+		"Hamburg":   {min: 10, max: 10, sum: 1000, count: 100, sumSquares: 10000},
+		"Palembang": {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+	}
+	if err := saveSnapshot(snapshot, prior); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot measurements are not processed lines but their stations are
+	var stderr bytes.Buffer
+	opts := &options{load: snapshot, summary: true, stderr: &stderr}
+	if err := run([]string{writeTempFile(t, "Hamburg;12.0\nBulawayo;8.9\n")}, opts, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "processed 2 lines, 3 stations\n"; stderr.String() != expected {
+		t.Errorf("Wrong summary, expected: %q, got: %q", expected, stderr.String())
+	}
+}
+
+func TestLoadSnapshotMalformed(t *testing.T) {
+	for _, data := range []string{"", "Foo;1.0\n", snapshotMagic + "\x03Fo"} {
+		if _, err := loadSnapshot(writeTempFile(t, data)); err == nil {
+			t.Errorf("Expected error for snapshot %q", data)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := saveSnapshot(empty, map[string]*measurement{}); err != nil {
+		t.Fatal(err)
+	}
+	if measurements, err := loadSnapshot(empty); err != nil || len(measurements) != 0 {
+		t.Errorf("Wrong empty snapshot: %v, %v", measurements, err)
+	}
+}
+
+func TestRunSnapshotUnsupported(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\n")
+	for _, opts := range []options{
+		{save: filename + ".snapshot", percentiles: true},
+		{load: filename + ".snapshot", sort: "first-seen"},
+		{load: filename + ".snapshot", verify: true},
+	} {
+		if err := run([]string{filename}, &opts, &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected error for unsupported options: %+v", opts)
+		}
+	}
+}
+
+func TestRunSnapshotOverflow(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nFoo;2.0\nBar;-1.0\n")
+
+	for _, tc := range []struct {
+		name  string
+		prior *measurement
+		fails bool
+	}{
+		{"count", &measurement{min: 10, max: 10, sum: 10, count: math.MaxInt64 - 1, sumSquares: 100}, true},
+		{"sum", &measurement{min: 10, max: 10, sum: math.MaxInt64 - 10, count: 1, sumSquares: 100}, true},
+		{"sum squares", &measurement{min: 10, max: 10, sum: 10, count: 1, sumSquares: math.MaxInt64 - 100}, true},
+		{"max count", &measurement{min: 10, max: 10, sum: 10, count: math.MaxInt64 - 2, sumSquares: 100}, false},
+	} {
+		snapshot := filepath.Join(t.TempDir(), "snapshot")
+		if err := saveSnapshot(snapshot, map[string]*measurement{"Foo": tc.prior}); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		err := run([]string{filename}, &options{load: snapshot, save: snapshot, count: true}, &buf)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("Expected %s overflow error", tc.name)
+			}
+			// the snapshot is not replaced on error
+			if saved, err := loadSnapshot(snapshot); err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(saved["Foo"], tc.prior) {
+				t.Errorf("Snapshot is replaced after %s overflow: %v", tc.name, saved["Foo"])
+			}
+		} else if err != nil {
+			t.Errorf("Unexpected error with %s: %v", tc.name, err)
+		} else if expected := fmt.Sprintf("Foo=1.0/0.0/2.0 (n=%d)", int64(math.MaxInt64)); !strings.Contains(buf.String(), expected) {
+			t.Errorf("Wrong output with %s, expected count: %s, got: %s", tc.name, expected, buf.String())
+		}
+	}
+}
+
+func TestAddOverflows(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     int64
+		expected bool
+	}{
+		{1, 2, false},
+		{math.MaxInt64, 0, false},
+		{math.MaxInt64 - 1, 1, false},
+		{math.MaxInt64, 1, true},
+		{1, math.MaxInt64, true},
+		{math.MinInt64 + 1, -1, false},
+		{math.MinInt64, -1, true},
+		{math.MinInt64, math.MaxInt64, false},
+	} {
+		if overflows := addOverflows(tc.a, tc.b); overflows != tc.expected {
+			t.Errorf("Wrong overflow of %d + %d, expected: %v, got: %v", tc.a, tc.b, tc.expected, overflows)
+		}
+	}
+}
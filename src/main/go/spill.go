@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// spillPartitions is the number of files stations are partitioned into by hash
+// so that every partition fits into memory when aggregated.
+const spillPartitions = 64
+
+// stationMemory approximates memory used by a station measurement besides its id.
+const stationMemory = 128
+
+// spill aggregates measurements of more stations than fit into memory.
+// It accumulates measurements until they exceed maxMemory, then appends them
+// to partition files by station hash and starts over.
+// Partitions are aggregated and sorted separately and merged by station name on output.
+type spill struct {
+	maxMemory int64
+	dir       string
+
+	measurements map[string]*measurement
+	memory       int64
+
+	partitions []*os.File
+	writers    []*bufio.Writer
+	// spilled reports whether any measurements were written to partitions
+	spilled bool
+}
+
+// newSpill returns spill that writes partitions into a new temporary directory.
+func newSpill(maxMemory int64) (*spill, error) {
+	dir, err := os.MkdirTemp("", "1brc-spill-")
+	if err != nil {
+		return nil, err
+	}
+	return &spill{maxMemory: maxMemory, dir: dir, measurements: make(map[string]*measurement)}, nil
+}
+
+// remove removes partition files.
+func (s *spill) remove() error {
+	for _, f := range s.partitions {
+		if f != nil {
+			f.Close()
+		}
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// add copies measurements of the table and spills them to partitions if they exceed maxMemory.
+func (s *spill) add(t *table) error {
+	for i := range t.entries {
+		e := &t.entries[i]
+		if e.count == 0 {
+			continue
+		}
+		if m := s.measurements[string(e.id)]; m == nil {
+			m := e.measurement
+			s.measurements[string(e.id)] = &m
+			s.memory += int64(len(e.id)) + stationMemory
+		} else {
+			m.merge(&e.measurement)
+		}
+	}
+	if s.memory > s.maxMemory {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush appends accumulated measurements to partitions.
+func (s *spill) flush() error {
+	if s.partitions == nil {
+		s.partitions = make([]*os.File, spillPartitions)
+		s.writers = make([]*bufio.Writer, spillPartitions)
+		for i := range s.partitions {
+			f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("partition-%d", i)))
+			if err != nil {
+				return err
+			}
+			s.partitions[i] = f
+			s.writers[i] = bufio.NewWriter(f)
+		}
+	}
+
+	var b []byte
+	for id, m := range s.measurements {
+		b = appendRecord(b[:0], id, m)
+		if _, err := s.writers[hashId([]byte(id))%spillPartitions].Write(b); err != nil {
+			return err
+		}
+	}
+	clear(s.measurements)
+	s.memory = 0
+	s.spilled = true
+	return nil
+}
+
+// finish returns accumulated measurements if they fit into memory,
+// otherwise it spills them and returns nil and true.
+func (s *spill) finish() (map[string]*measurement, bool, error) {
+	if !s.spilled {
+		return s.measurements, false, nil
+	}
+	if err := s.flush(); err != nil {
+		return nil, false, err
+	}
+	for _, w := range s.writers {
+		if err := w.Flush(); err != nil {
+			return nil, false, err
+		}
+	}
+	return nil, true, nil
+}
+
+// write aggregates and sorts every partition, then writes stations in name order
+// merging the sorted partitions.
+func (s *spill) write(w io.Writer, f lineFormat, opts *options) error {
+	runs := make([]*bufio.Reader, len(s.partitions))
+	for i, p := range s.partitions {
+		r, err := s.sortPartition(p)
+		if err != nil {
+			return err
+		}
+		runs[i] = r
+	}
+
+	h := make(recordHeap, 0, len(runs))
+	for _, r := range runs {
+		if id, m, err := readRecord(r); err == nil {
+			h = append(h, record{id, m, r})
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	heap.Init(&h)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(f.start)
+	var b []byte
+	for n := 0; len(h) > 0; n++ {
+		if n > 0 {
+			bw.WriteString(f.separator)
+		}
+		top := &h[0]
+		b = f.appendStats(b[:0], top.id, opts.stats(top.m), true, opts)
+		bw.Write(b)
+
+		// stations are partitioned by hash so every station is in a single run
+		if id, m, err := readRecord(top.r); err == nil {
+			top.id, top.m = id, m
+			heap.Fix(&h, 0)
+		} else if err == io.EOF {
+			heap.Pop(&h)
+		} else {
+			return err
+		}
+	}
+	bw.WriteString(f.end)
+	return bw.Flush()
+}
+
+// sortPartition aggregates measurements of the partition and replaces it with
+// the measurements sorted by station name.
+func (s *spill) sortPartition(p *os.File) (*bufio.Reader, error) {
+	if _, err := p.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	measurements := make(map[string]*measurement)
+	r := bufio.NewReader(p)
+	for {
+		id, m, err := readRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		mergeMeasurement(measurements, []byte(id), m)
+	}
+
+	if err := p.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := p.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(p)
+	var b []byte
+	for _, id := range slices.Sorted(maps.Keys(measurements)) {
+		b = appendRecord(b[:0], id, measurements[id])
+		if _, err := bw.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := p.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(p), nil
+}
+
+// checkSpill returns error if options need all stations in memory
+// or measurement state that is not spilled.
+func (opts *options) checkSpill() error {
+	if _, ok := lineFormats[opts.format]; !ok {
+		return fmt.Errorf("max memory is not supported with %s format", opts.format)
+	}
+	for _, o := range []struct {
+		enabled bool
+		flag    string
+	}{
+		{opts.sort != "" && opts.sort != "name", "-sort"},
+		{opts.collate != "" && opts.collate != "byte", "-collate"},
+		{opts.top > 0, "-top"},
+		{opts.include != "", "-include"},
+		{opts.exclude != "", "-exclude"},
+		{opts.stationsFile != "", "-stations-file"},
+		{opts.global, "-global"},
+		{opts.percentiles, "-percentiles"},
+		{opts.verify, "-verify"},
+		{opts.summary, "-stats"},
+		{opts.extremes, "-extremes"},
+	} {
+		if o.enabled {
+			return fmt.Errorf("max memory is not supported with %s", o.flag)
+		}
+	}
+	return nil
+}
+
+// appendRecord appends varint encoded station measurement to b.
+func appendRecord(b []byte, id string, m *measurement) []byte {
+	b = binary.AppendUvarint(b, uint64(len(id)))
+	b = append(b, id...)
+	for _, v := range []int64{m.min, m.max, m.sum, m.count, m.sumSquares} {
+		b = binary.AppendVarint(b, v)
+	}
+	if m.span == nil {
+		return append(b, 0)
+	}
+	b = append(b, 1)
+	b = binary.AppendVarint(b, m.span.first)
+	return binary.AppendVarint(b, m.span.last)
+}
+
+// readRecord reads station measurement appended by appendRecord, it returns io.EOF at the end of r.
+func readRecord(r *bufio.Reader) (string, *measurement, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, n)
+	var values [5]int64
+	if _, err = io.ReadFull(r, id); err != nil {
+		return "", nil, noEOF(err)
+	}
+	for i := range values {
+		if values[i], err = binary.ReadVarint(r); err != nil {
+			return "", nil, noEOF(err)
+		}
+	}
+	m := &measurement{min: values[0], max: values[1], sum: values[2], count: values[3], sumSquares: values[4]}
+	if hasSpan, err := r.ReadByte(); err != nil {
+		return "", nil, noEOF(err)
+	} else if hasSpan == 1 {
+		m.span = new(timeSpan)
+		if m.span.first, err = binary.ReadVarint(r); err != nil {
+			return "", nil, noEOF(err)
+		}
+		if m.span.last, err = binary.ReadVarint(r); err != nil {
+			return "", nil, noEOF(err)
+		}
+	}
+	return string(id), m, nil
+}
+
+// noEOF converts io.EOF in the middle of a record into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// record is the next station of a sorted run.
+type record struct {
+	id string
+	m  *measurement
+	r  *bufio.Reader
+}
+
+// recordHeap orders the next stations of sorted runs by name.
+type recordHeap []record
+
+func (h recordHeap) Len() int           { return len(h) }
+func (h recordHeap) Less(i, j int) bool { return h[i].id < h[j].id }
+func (h recordHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x any)        { *h = append(*h, x.(record)) }
+func (h *recordHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunMaxMemory(t *testing.T) {
+	// more than one stream buffer of lines of many stations
+	r := rand.New(rand.NewSource(1))
+	var sb strings.Builder
+	for sb.Len() <= streamBufferSize {
+		fmt.Fprintf(&sb, "station-%d;%.1f\n", r.Intn(50_000), float64(r.Intn(1999)-999)/10)
+	}
+	filename := writeTempFile(t, sb.String())
+
+	s, err := newSpill(64 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.remove()
+	if _, err := processFiles([]string{filename}, &options{spill: s}); err != nil {
+		t.Fatal(err)
+	}
+	if _, spilled, err := s.finish(); err != nil || !spilled {
+		t.Fatalf("Expected spilled measurements, got: %v, %v", spilled, err)
+	}
+
+	for _, opts := range []options{
+		{},
+		{format: "compact", count: true, stddev: true},
+	} {
+		var expected bytes.Buffer
+		if err := run([]string{filename}, &opts, &expected); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, maxMemory := range []int64{64 << 10, 1 << 30} {
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+
+			var got bytes.Buffer
+			opts.maxMemory = maxMemory
+			if err := run([]string{filename}, &opts, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != expected.String() {
+				t.Errorf("Wrong output of %q format with max memory %d", opts.format, maxMemory)
+			}
+			if entries, err := os.ReadDir(tmp); err != nil {
+				t.Fatal(err)
+			} else if len(entries) != 0 {
+				t.Errorf("Spill files are not removed: %v", entries)
+			}
+		}
+	}
+}
+
+func TestRunMaxMemoryUnsupported(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\n")
+	for _, opts := range []options{
+		{maxMemory: 1, format: "json"},
+		{maxMemory: 1, sort: "max"},
+		{maxMemory: 1, percentiles: true},
+		{maxMemory: 1, verify: true},
+	} {
+		if err := run([]string{filename}, &opts, nil); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
+
+func TestSpillRecord(t *testing.T) {
+	for _, m := range []*measurement{
+		{min: -999, max: 999, sum: 0, count: 2, sumSquares: 2 * 999 * 999},
+		{min: 12, max: 12, sum: 12, count: 1, sumSquares: 144, span: &timeSpan{first: 1700000000, last: 1700000900}},
+	} {
+		b := appendRecord(nil, "Foo", m)
+		id, got, err := readRecord(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "Foo" || !reflect.DeepEqual(got, m) {
+			t.Errorf("Wrong record, expected: Foo %v, got: %s %v", m, id, got)
+		}
+		if _, _, err := readRecord(bufio.NewReader(bytes.NewReader(b[:len(b)-1]))); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected unexpected EOF for truncated record, got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const streamBufferSize = 4 << 20
+
+// maxLineSize limits the size the stream buffer grows to for long lines,
+// it is a variable to test the limit.
+var maxLineSize = 64 << 20
+
+// decompressors read compressed formats detected by their magic header.
+var decompressors = []struct {
+	magic     func(header []byte) bool
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}{
+	{
+		magic:     func(header []byte) bool { return bytes.HasPrefix(header, []byte{0x1f, 0x8b}) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	{
+		// "BZh" is followed by the block size digit and the 0x314159265359 block magic,
+		// match them too as plain text may start with "BZh"
+		magic: func(header []byte) bool {
+			return len(header) >= 10 && bytes.HasPrefix(header, []byte("BZh")) &&
+				header[3] >= '1' && header[3] <= '9' && bytes.Equal(header[4:10], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59})
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(bzip2.NewReader(r)), nil },
+	},
+	{
+		magic: func(header []byte) bool { return bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		},
+	},
+}
+
+// headerSize is the size of file header that contains magic of all decompressors.
+const headerSize = 10
+
+// decompressor returns reader constructor of the compression format of the header, nil if not compressed.
+func decompressor(header []byte) func(r io.Reader) (io.ReadCloser, error) {
+	for _, d := range decompressors {
+		if d.magic(header) {
+			return d.newReader
+		}
+	}
+	return nil
+}
+
+// isCompressed checks whether file starts with a known compression format magic header.
+func isCompressed(f *os.File) (bool, error) {
+	header := make([]byte, headerSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return decompressor(header[:n]) != nil, nil
+}
+
+// decompress returns reader of r decompressing it if necessary.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if newReader := decompressor(header); newReader != nil {
+		return newReader(br)
+	}
+	return io.NopCloser(br), nil
+}
+
+// processStream aggregates measurements read from r decompressing it if necessary.
+func processStream(r io.Reader, opts *options) (map[string]*measurement, error) {
+	if opts.byteRange() {
+		// offsets of decompressed or piped input do not match file offsets
+		return nil, errors.New("byte range is not supported for streamed input")
+	}
+	zr, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return processReader(zr, streamBufferSize, opts)
+}
+
+// addMeasurements copies measurements of the table into dst or the spill if enabled.
+func addMeasurements(dst map[string]*measurement, t *table, opts *options) error {
+	if opts.spill != nil {
+		return opts.spill.add(t)
+	}
+	copyMeasurements(dst, t)
+	return nil
+}
+
+// processReader aggregates measurements read from r which can not be mmaped, e.g. a pipe.
+// It processes input in buffer-sized portions carrying incomplete last line over to the next one
+// so it is slower than the mmap path but produces the same result.
+// The buffer grows up to maxLineSize to fit lines longer than the bufferSize.
+func processReader(r io.Reader, bufferSize int, opts *options) (map[string]*measurement, error) {
+	measurements := make(map[string]*measurement)
+	t := newChunkTable(opts)
+	buf := make([]byte, bufferSize)
+	n := 0
+	offset := 0
+	for {
+		read, err := io.ReadFull(r, buf[n:])
+		n += read
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			data := buf[:n]
+			if n > 0 && data[n-1] != '\n' {
+				data = append(data, '\n')
+			}
+			if err := processChunkInto(t, data, offset, opts); err != nil {
+				return nil, err
+			}
+			if err := addMeasurements(measurements, t, opts); err != nil {
+				return nil, err
+			}
+			return measurements, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		nlPos := bytes.LastIndexByte(buf, '\n')
+		if nlPos == -1 {
+			if len(buf) >= maxLineSize {
+				return nil, fmt.Errorf("line at offset %d exceeds maximum size %d", offset, maxLineSize)
+			}
+			buf = append(buf, make([]byte, min(len(buf), maxLineSize-len(buf)))...)
+			continue
+		}
+		if err := processChunkInto(t, buf[:nlPos+1], offset, opts); err != nil {
+			return nil, err
+		}
+		// copy measurements to reuse the table and buffer referenced by its entries
+		if err := addMeasurements(measurements, t, opts); err != nil {
+			return nil, err
+		}
+		if opts.limit != nil && opts.limit.exhausted() {
+			return measurements, nil
+		}
+		t.reset()
+		n = copy(buf, buf[nlPos+1:])
+		offset += nlPos + 1
+	}
+}
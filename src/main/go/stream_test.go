@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestProcessReader(t *testing.T) {
+	filenames, err := filepath.Glob("../../test/resources/samples/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) == 0 {
+		t.Fatal("No samples found")
+	}
+
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opts := range []*options{{}, {percentiles: true}} {
+			expected := mustProcess(t, data, opts)
+
+			// small buffer stitches lines across many reads
+			for _, bufferSize := range []int{128, 1024, streamBufferSize} {
+				measurements, err := processReader(bytes.NewReader(data), bufferSize, opts)
+				if err != nil {
+					t.Fatalf("%s: %v", filename, err)
+				}
+				if !reflect.DeepEqual(measurements, expected) {
+					t.Errorf("%s: streaming with buffer size %d and %+v differs from mmap result", filename, bufferSize, *opts)
+				}
+			}
+		}
+	}
+}
+
+func TestAggregateGzip(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gzFilename := filepath.Join(t.TempDir(), "measurements.txt.gz")
+	if err := os.WriteFile(gzFilename, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measurements, err := Aggregate(gzFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Result of gzip compressed file differs from uncompressed one")
+	}
+}
+
+func TestAggregateBzip2(t *testing.T) {
+	// Go has no bzip2 compressor, the file is compressed by bzip2 -9
+	const bz2Filename = "testdata/measurements-10000-unique-keys.txt.bz2"
+
+	expected, err := Aggregate("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measurements, err := Aggregate(bz2Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Result of bzip2 compressed file differs from uncompressed one")
+	}
+	if err := run([]string{bz2Filename}, &options{verify: true}, io.Discard); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregateZstd(t *testing.T) {
+	const filename = "../../test/resources/samples/measurements-10000-unique-keys.txt"
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstFilename := filepath.Join(t.TempDir(), "measurements.txt.zst")
+	if err := os.WriteFile(zstFilename, zw.EncodeAll(data, nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measurements, err := Aggregate(zstFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Result of zstd compressed file differs from uncompressed one")
+	}
+	if err := run([]string{zstFilename}, &options{verify: true}, io.Discard); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregateBzip2LikeText(t *testing.T) {
+	measurements, err := Aggregate(writeTempFile(t, "BZh1;1.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := measurements["BZh1"]; !ok || s.Count() != 1 {
+		t.Errorf("Wrong aggregation of plain text: %v", measurements)
+	}
+}
+
+func TestAggregateReader(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+		expected    map[string]int64
+	}{
+		{"empty", "", map[string]int64{}},
+		{"single", "Foo;1.0\n", map[string]int64{"Foo": 1}},
+		{"no trailing newline", "Foo;1.0\nBar;-2.5\nFoo;3.0", map[string]int64{"Foo": 2, "Bar": 1}},
+		{"crlf", "Foo;1.0\r\nFoo;2.0\r\n", map[string]int64{"Foo": 2}},
+		{"unicode", "Ärhus;5.0\nİzmir;6.0\nÄrhus;7.0\n", map[string]int64{"Ärhus": 2, "İzmir": 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			measurements, err := AggregateReader(strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts := make(map[string]int64)
+			for id, s := range measurements {
+				counts[id] = s.Count()
+			}
+			if !reflect.DeepEqual(counts, tc.expected) {
+				t.Errorf("Wrong station counts, expected: %v, got: %v", tc.expected, counts)
+			}
+
+			expected, err := Aggregate(writeTempFile(t, tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("Result differs from file aggregation, expected: %v, got: %v", expected, measurements)
+			}
+		})
+	}
+
+	data, err := os.ReadFile("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurements, err := AggregateReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := Aggregate("../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Result of reader differs from file aggregation")
+	}
+}
+
+func TestProcessReaderMissingTrailingNewline(t *testing.T) {
+	measurements, err := processReader(bytes.NewReader([]byte("Foo;1.2\nFoo;3.4")), 8, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]*measurement{"Foo": {min: 12, max: 34, sum: 46, count: 2, sumSquares: 12*12 + 34*34}}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Errorf("Wrong aggregation, expected: %v, got: %v", expected, measurements)
+	}
+}
+
+func TestProcessReaderLongLine(t *testing.T) {
+	longName := strings.Repeat("x", 1<<20)
+	input := "Foo;1.0\n" + longName + ";1.2\nFoo;3.0\n"
+
+	measurements, err := processReader(strings.NewReader(input), 128, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]*measurement{
+		"Foo":    {min: 10, max: 30, sum: 40, count: 2, sumSquares: 100 + 900},
+		longName: {min: 12, max: 12, sum: 12, count: 1, sumSquares: 144},
+	}
+	if !reflect.DeepEqual(measurements, expected) {
+		t.Error("Wrong aggregation of long line")
+	}
+
+	defer func(n int) { maxLineSize = n }(maxLineSize)
+	maxLineSize = 1 << 19
+
+	if _, err := processReader(strings.NewReader(input), 128, &options{}); err == nil {
+		t.Error("Expected error for line exceeding maximum size")
+	}
+}
+
+// BenchmarkProcessReader measures allocations of the streaming path that reuses chunk table
+// for every buffer of many stations.
+func BenchmarkProcessReader(b *testing.B) {
+	const nStations = 10_000
+
+	var data bytes.Buffer
+	for i := 0; i < 100*nStations; i++ {
+		fmt.Fprintf(&data, "station-%d;%d.%d\n", i%nStations, i%100, i%10)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(data.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := processReader(bytes.NewReader(data.Bytes()), 1<<20, &options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
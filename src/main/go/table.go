@@ -0,0 +1,134 @@
+package main
+
+import "bytes"
+
+// table is an open addressing hash table of station measurements.
+// It stores measurement and station id inline to avoid pointer chasing
+// and uses linear probing over power of 2 number of entries.
+type table struct {
+	entries []entry
+	size    int
+	// histograms enables tracking of measurement histograms
+	histograms bool
+}
+
+type entry struct {
+	key uint64
+	id  []byte
+	measurement
+}
+
+const initialTableSize = 1 << 12
+
+// newTable returns table presized for the expected number of stations.
+func newTable(stations int) *table {
+	n := initialTableSize
+	for n < 2*stations {
+		n *= 2
+	}
+	return &table{entries: make([]entry, n)}
+}
+
+// get returns entry for the key and id or empty entry with zero count that
+// should be initialized and followed by the added call.
+// Different ids may have the same key so it compares ids to handle collisions.
+func (t *table) get(key uint64, id []byte) *entry {
+	mask := uint64(len(t.entries) - 1)
+	for i := key & mask; ; i = (i + 1) & mask {
+		e := &t.entries[i]
+		if e.count == 0 {
+			e.key = key
+			return e
+		}
+		if e.key == key && bytes.Equal(e.id, id) {
+			return e
+		}
+	}
+}
+
+// added accounts for a new entry and grows the table to keep load factor below 1/2.
+func (t *table) added() {
+	t.size++
+	if t.size*2 <= len(t.entries) {
+		return
+	}
+
+	entries := t.entries
+	t.entries = make([]entry, 2*len(entries))
+	mask := uint64(len(t.entries) - 1)
+	for _, e := range entries {
+		if e.count == 0 {
+			continue
+		}
+		i := e.key & mask
+		for t.entries[i].count != 0 {
+			i = (i + 1) & mask
+		}
+		t.entries[i] = e
+	}
+}
+
+// reset removes all entries keeping the table size.
+func (t *table) reset() {
+	clear(t.entries)
+	t.size = 0
+}
+
+// keyMask is applied to keys of added measurements.
+// It is a variable to force key collisions in tests.
+var keyMask = ^uint64(0)
+
+// add adds temperature measurement of the station.
+func (t *table) add(key uint64, id []byte, temp int64) {
+	key &= keyMask
+	e := t.get(key, id)
+	if e.count == 0 {
+		e.id = id
+		e.measurement = measurement{
+			min:        temp,
+			max:        temp,
+			sum:        temp,
+			count:      1,
+			sumSquares: temp * temp,
+		}
+		if t.histograms {
+			e.hist = new(histogram)
+			e.hist.add(temp, 1)
+		}
+		t.added()
+	} else {
+		e.update(temp, temp, temp, 1, temp*temp)
+		if t.histograms {
+			e.hist.add(temp, 1)
+		}
+	}
+}
+
+// duplicateId returns id of a station that has more than one entry.
+func (t *table) duplicateId() (string, bool) {
+	ids := make(map[string]struct{}, t.size)
+	for i := range t.entries {
+		e := &t.entries[i]
+		if e.count == 0 {
+			continue
+		}
+		if _, ok := ids[string(e.id)]; ok {
+			return string(e.id), true
+		}
+		ids[string(e.id)] = struct{}{}
+	}
+	return "", false
+}
+
+// result returns table measurements keyed by station id.
+// Returned measurements point to table entries.
+func (t *table) result() map[string]*measurement {
+	result := make(map[string]*measurement, t.size)
+	for i := range t.entries {
+		e := &t.entries[i]
+		if e.count != 0 {
+			result[string(e.id)] = &e.measurement
+		}
+	}
+	return result
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// timeSpan is the range of measurement timestamps.
+type timeSpan struct {
+	first, last int64
+}
+
+func (s *timeSpan) add(ts int64) {
+	s.first = min(s.first, ts)
+	s.last = max(s.last, ts)
+}
+
+func (s *timeSpan) merge(o *timeSpan) {
+	s.first = min(s.first, o.first)
+	s.last = max(s.last, o.last)
+}
+
+// addTimestamp extends timestamp range of the measurement.
+func (m *measurement) addTimestamp(ts int64) {
+	if m.span == nil {
+		m.span = &timeSpan{first: ts, last: ts}
+	} else {
+		m.span.add(ts)
+	}
+}
+
+// cutTimestamp slices value before the optional timestamp column and parses the timestamp.
+// It returns false if the timestamp is malformed.
+func cutTimestamp(value []byte, delimiter byte) (temp []byte, ts int64, found, ok bool) {
+	temp, tsData, found := bytes.Cut(value, []byte{delimiter})
+	if !found {
+		return value, 0, false, true
+	}
+	ts, err := strconv.ParseInt(string(tsData), 10, 64)
+	return temp, ts, true, err == nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestProcessTimestamps(t *testing.T) {
+	const input = "Foo;1.0;1700000300\nBar;2.0;1700000100\nFoo;3.0;1700000000\nBaz;4.0\nFoo;2.0;1700000900\nBar;1.0;1700000200\nBaz;5.0\n"
+
+	expected := map[string]*measurement{
+		"Foo": {min: 10, max: 30, sum: 60, count: 3, sumSquares: 100 + 900 + 400, span: &timeSpan{first: 1700000000, last: 1700000900}},
+		"Bar": {min: 10, max: 20, sum: 30, count: 2, sumSquares: 400 + 100, span: &timeSpan{first: 1700000100, last: 1700000200}},
+		"Baz": {min: 40, max: 50, sum: 90, count: 2, sumSquares: 1600 + 2500},
+	}
+	for _, workers := range []int{1, 3, 16} {
+		if measurements := mustProcess(t, []byte(input), &options{workers: workers, withTimestamp: true}); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong aggregation with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
+	}
+	if measurements, err := processReader(bytes.NewReader([]byte(input)), 32, &options{withTimestamp: true}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(measurements, expected) {
+		t.Errorf("Wrong streaming aggregation, expected: %v, got: %v", expected, measurements)
+	}
+
+	var stdout bytes.Buffer
+	if err := run([]string{writeTempFile(t, input)}, &options{withTimestamp: true, verify: true, global: true}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Bar=1.0/1.5/2.0/1700000100/1700000200, Baz=4.0/4.5/5.0, Foo=1.0/2.0/3.0/1700000000/1700000900, __global__=1.0/2.6/5.0/1700000000/1700000900}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+
+	if _, err := process([]byte("Foo;1.0;x\n"), &options{withTimestamp: true, strict: true}); err == nil {
+		t.Error("Expected error for malformed timestamp")
+	}
+}
+
+func TestProcessTimestampsValueFirst(t *testing.T) {
+	const input = "1.0;Foo;1700000300\n2.0;Bar\n3.0;Foo;1700000000\n"
+
+	expected := map[string]*measurement{
+		"Foo": {min: 10, max: 30, sum: 40, count: 2, sumSquares: 100 + 900, span: &timeSpan{first: 1700000000, last: 1700000300}},
+		"Bar": {min: 20, max: 20, sum: 20, count: 1, sumSquares: 400},
+	}
+	for _, workers := range []int{1, 3} {
+		opts := &options{workers: workers, valueFirst: true, withTimestamp: true, strict: true}
+		if measurements := mustProcess(t, []byte(input), opts); !reflect.DeepEqual(measurements, expected) {
+			t.Errorf("Wrong aggregation with %d workers, expected: %v, got: %v", workers, expected, measurements)
+		}
+	}
+
+	var stdout bytes.Buffer
+	if err := run([]string{writeTempFile(t, input)}, &options{valueFirst: true, withTimestamp: true, verify: true}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Bar=2.0/2.0/2.0, Foo=1.0/2.0/3.0/1700000000/1700000300}\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected: %q, got: %q", expected, stdout.String())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// phases lists the timed phases in processing order.
+var phases = []string{"mmap", "chunk", "process", "merge", "print"}
+
+// timings accumulates wall time of processing phases over all processed files.
+type timings struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+// add adds the duration to the phase.
+func (t *timings) add(phase string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.durations == nil {
+		t.durations = make(map[string]time.Duration)
+	}
+	t.durations[phase] += d
+}
+
+// report writes nanoseconds spent in every phase to w, phases that did not run are omitted.
+func (t *timings) report(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, phase := range phases {
+		if d, ok := t.durations[phase]; ok {
+			if _, err := fmt.Fprintf(w, "timing %s %d ns\n", phase, d.Nanoseconds()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// timePhase adds time elapsed since start to the phase if timings are enabled.
+func (opts *options) timePhase(phase string, start time.Time) {
+	if opts.timings != nil {
+		opts.timings.add(phase, time.Since(start))
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRunTimings(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;2.0\nFoo;3.0\n")
+
+	var stderr bytes.Buffer
+	opts := &options{workers: 3, timings: new(timings), stderr: &stderr}
+	if err := run([]string{filename}, opts, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if len(lines) != len(phases) {
+		t.Fatalf("Wrong number of timing lines, expected: %d, got: %q", len(phases), lines)
+	}
+	for i, line := range lines {
+		var phase string
+		var ns int64
+		if _, err := fmt.Sscanf(line, "timing %s %d ns", &phase, &ns); err != nil {
+			t.Errorf("Malformed timing line %q: %v", line, err)
+		} else if phase != phases[i] || ns < 0 {
+			t.Errorf("Wrong timing line, expected phase: %s with non-negative duration, got: %q", phases[i], line)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// verify aggregates files by the simple serial reference implementation and
+// compares the result with measurements computed by the parallel pipeline.
+// It writes mismatching stations to w and returns an error if there are any.
+func verify(w io.Writer, filenames []string, measurements map[string]Stats, opts *options) error {
+	expected := make(map[string]*measurement)
+	for _, filename := range filenames {
+		if filename == "-" {
+			return errors.New("can not verify stdin")
+		}
+		fm, err := aggregateSerial(filename, opts)
+		if err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+		mergeMeasurements(expected, fm)
+	}
+
+	ids := make(map[string]struct{}, len(expected))
+	for id := range expected {
+		ids[id] = struct{}{}
+	}
+	for id := range measurements {
+		ids[id] = struct{}{}
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	mismatches := 0
+	for _, id := range sorted {
+		var es Stats
+		if m, ok := expected[id]; ok {
+			es = opts.stats(m)
+		}
+		s := measurements[id]
+		// percentiles and first-seen offsets are not tracked by the reference implementation
+		s.P50, s.P95, s.P99, s.firstSeen = 0, 0, 0, 0
+		if s != es {
+			mismatches++
+			if _, err := fmt.Fprintf(w, "%s: expected %+v, got %+v\n", id, es, s); err != nil {
+				return err
+			}
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("verification failed: %d of %d stations differ", mismatches, len(sorted))
+	}
+	return nil
+}
+
+// aggregateSerial is the reference implementation that aggregates measurements of the file line by line.
+func aggregateSerial(filename string, opts *options) (map[string]*measurement, error) {
+	delimiter := opts.delimiter
+	if delimiter == 0 {
+		delimiter = ';'
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	measurements := make(map[string]*measurement)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte{'\r'})
+		if len(line) == 0 || opts.ignoreComments && isComment(line) {
+			continue
+		}
+
+		var id, value []byte
+		var ok bool
+		if opts.escape {
+			id, value, ok = cutEscaped(line, delimiter)
+		} else {
+			id, value, ok = bytes.Cut(line, []byte{delimiter})
+		}
+		if opts.valueFirst {
+			id, value = value, id
+		}
+		var tsData []byte
+		hasTimestamp := false
+		if opts.withTimestamp && opts.valueFirst {
+			id, tsData, hasTimestamp = bytes.Cut(id, []byte{delimiter})
+		} else if opts.withTimestamp {
+			value, tsData, hasTimestamp = bytes.Cut(value, []byte{delimiter})
+		}
+		if !ok {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+		var temp int64
+		if !isMissingValue(value) {
+			temp = parseNumber(value)
+		} else if opts.missingValues == "error" {
+			return nil, fmt.Errorf("missing value: %q", line)
+		} else if opts.missingValues != "zero" {
+			continue
+		}
+		if opts.allowExponent && bytes.ContainsAny(value, "eE") {
+			var err error
+			if temp, err = parseDegrees(string(value)); err != nil {
+				return nil, fmt.Errorf("malformed line: %q", line)
+			}
+		}
+		if opts.tempFilter && (temp < opts.minTemp || temp > opts.maxTemp) {
+			continue
+		}
+		if opts.normalize != "" {
+			id = bytes.TrimSpace(id)
+		}
+		if opts.escape {
+			id = appendUnescaped(nil, id)
+		}
+		if opts.normalize == "fold" {
+			id = bytes.ToLower(id)
+		}
+		if opts.groupSep != "" {
+			id = groupPrefix(id, []byte(opts.groupSep), opts.groupLevels())
+		}
+
+		m := measurements[string(id)]
+		if m == nil {
+			m = &measurement{min: temp, max: temp}
+			measurements[string(id)] = m
+		}
+		m.min = min(m.min, temp)
+		m.max = max(m.max, temp)
+		m.sum += temp
+		m.count++
+		m.sumSquares += temp * temp
+		if hasTimestamp {
+			ts, err := strconv.ParseInt(string(tsData), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed line: %q", line)
+			}
+			m.addTimestamp(ts)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return measurements, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	filenames, err := filepath.Glob("../../test/resources/samples/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filenames = append(filenames, writeTempFile(t, "Foo;1.0\r\n\r\nBar;12\r\nFoo;-3.5"))
+
+	for _, filename := range filenames {
+		for _, opts := range []*options{{}, {workers: 1}, {workers: 7, percentiles: true}, {normalize: "fold"}} {
+			measurements, err := aggregate([]string{filename}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verify(io.Discard, []string{filename}, measurements, opts); err != nil {
+				t.Errorf("%s: %v", filename, err)
+			}
+		}
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	filename := writeTempFile(t, "Foo;1.0\nBar;2.0\nFoo;3.0\n")
+
+	measurements, err := Aggregate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := measurements["Foo"]
+	foo.max = 4.0
+	measurements["Foo"] = foo
+	delete(measurements, "Bar")
+	measurements["Baz"] = Stats{min: 1, max: 1, sum: 1, count: 1}
+
+	var diff bytes.Buffer
+	err = verify(&diff, []string{filename}, measurements, &options{})
+	if err == nil || err.Error() != "verification failed: 3 of 3 stations differ" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, id := range []string{"Bar", "Baz", "Foo"} {
+		if !strings.Contains(diff.String(), id+": expected") {
+			t.Errorf("Missing %s in diff: %s", id, diff.String())
+		}
+	}
+}
+
+func TestVerifyStdin(t *testing.T) {
+	if err := verify(io.Discard, []string{"-"}, nil, &options{}); err == nil {
+		t.Error("Expected error for stdin")
+	}
+}